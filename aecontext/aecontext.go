@@ -0,0 +1,63 @@
+// Package aecontext provides a context.Context for testing code written
+// against the google.golang.org/appengine packages.
+//
+// API calls are routed, with appengine.WithAPICallFunc, to the
+// dev_appserver.py child of an appenginetesting.Context, so code using the
+// appengine packages and code using google.golang.org/appengine can be tested
+// against the same datastore, memcache, etc.:
+//
+//	ctx, done, err := aecontext.NewContext(nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer done()
+//	err = memcache.Set(ctx, &memcache.Item{Key: "k", Value: []byte("v")})
+//
+// The memcache and task queue calls are translated into the messages of the
+// appengine packages, so the Context's current namespace and its clock apply
+// to them as well.
+//
+// Only API calls are routed, not the app ID, which google.golang.org/appengine
+// only reads from a context made from an incoming request.  So the datastore,
+// whose keys all need the app ID, can't be used with these contexts; use the
+// appengine packages with the appenginetesting.Context for it.
+package aecontext
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+
+	"github.com/mzimmerman/appenginetesting"
+)
+
+// NewContext starts a new appenginetesting.Context and returns a
+// context.Context for it, along with a function that closes it and returns
+// the error of appenginetesting.Context.Close.  A nil Options is valid and
+// means to use the default values.
+func NewContext(opts *appenginetesting.Options) (context.Context, func() error, error) {
+	c, err := appenginetesting.NewContext(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Wrap(context.Background(), c), c.Close, nil
+}
+
+// Wrap returns a copy of parent whose API calls go to the child of c, like
+// those made with c itself.
+func Wrap(parent context.Context, c *appenginetesting.Context) context.Context {
+	return appengine.WithAPICallFunc(parent, func(ctx context.Context, service, method string, in, out proto.Message) error {
+		newMessages, ok := classicMessages[service+"."+method]
+		if !ok {
+			return c.Call(service, method, in, out, nil)
+		}
+		classicIn, classicOut := newMessages()
+		if err := convert(in, classicIn); err != nil {
+			return err
+		}
+		if err := c.Call(service, method, classicIn, classicOut, nil); err != nil {
+			return err
+		}
+		return convert(classicOut, out)
+	})
+}
@@ -0,0 +1,97 @@
+package aecontext
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
+
+	classic "appengine/memcache"
+	classictq "appengine/taskqueue"
+
+	"github.com/mzimmerman/appenginetesting"
+)
+
+func TestNewContext(t *testing.T) {
+	ctx, done, err := NewContext(&appenginetesting.Options{Testing: t, Debug: appenginetesting.LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer func() {
+		if err := done(); err != nil {
+			t.Errorf("done: %v", err)
+		}
+	}()
+
+	if err = memcache.Set(ctx, &memcache.Item{Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	if item, err := memcache.Get(ctx, "k"); err != nil || string(item.Value) != "v" {
+		t.Errorf("memcache.Get = %v, %v; want v", item, err)
+	}
+	if _, err = memcache.Get(ctx, "missing"); err != memcache.ErrCacheMiss {
+		t.Errorf("memcache.Get of a missing key = %v; want ErrCacheMiss", err)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	c, err := appenginetesting.NewContext(&appenginetesting.Options{Testing: t, Debug: appenginetesting.LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	ctx := Wrap(context.Background(), c)
+
+	if err = classic.Set(c, &classic.Item{Key: "shared", Value: []byte("classic")}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	if item, err := memcache.Get(ctx, "shared"); err != nil || string(item.Value) != "classic" {
+		t.Errorf("memcache.Get of an item set through the Context = %v, %v; want classic", item, err)
+	}
+}
+
+func TestTranslatedCalls(t *testing.T) {
+	c, err := appenginetesting.NewContext(&appenginetesting.Options{
+		Testing:    t,
+		Debug:      appenginetesting.LogDebug,
+		TaskQueues: []string{"testQueue"},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	ctx := Wrap(context.Background(), c)
+
+	// the Context's namespace applies to the calls of ctx
+	c.CurrentNamespace("other")
+	if err = memcache.Set(ctx, &memcache.Item{Key: "ns", Value: []byte("other")}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	if _, err = classic.Get(c, "ns"); err != nil {
+		t.Errorf("memcache.Get in namespace other = %v; want the item set through ctx", err)
+	}
+	c.CurrentNamespace("")
+	if _, err = classic.Get(c, "ns"); err != classic.ErrCacheMiss {
+		t.Errorf("memcache.Get in the default namespace = %v; want ErrCacheMiss", err)
+	}
+
+	// and so does the clock
+	if err = memcache.Set(ctx, &memcache.Item{Key: "expiring", Value: []byte("v"), Expiration: time.Hour}); err != nil {
+		t.Fatalf("memcache.Set: %v", err)
+	}
+	c.Clock().Advance(61 * time.Minute)
+	if _, err = memcache.Get(ctx, "expiring"); err != memcache.ErrCacheMiss {
+		t.Errorf("memcache.Get after expiration = %v; want ErrCacheMiss", err)
+	}
+
+	// task queue calls are translated too
+	if _, err = taskqueue.Add(ctx, taskqueue.NewPOSTTask("/post", nil), "testQueue"); err != nil {
+		t.Fatalf("taskqueue.Add: %v", err)
+	}
+	stats, err := classictq.QueueStats(c, []string{"testQueue"}, 0)
+	if err != nil || len(stats) != 1 || stats[0].Tasks != 1 {
+		t.Errorf("QueueStats = %#v, %v; want the task added through ctx", stats, err)
+	}
+}
@@ -0,0 +1,60 @@
+package aecontext
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	memcachepb "appengine_internal/memcache"
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// classicMessages makes the request and response of the memcache and task
+// queue calls that appenginetesting.Context inspects, for its namespace and
+// its clock, as the messages of the appengine packages.  The messages of
+// google.golang.org/appengine have the same wire format but are different
+// types, which the Context would not recognize.
+var classicMessages = map[string]func() (in, out proto.Message){
+	"memcache.Get": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheGetRequest{}, &memcachepb.MemcacheGetResponse{}
+	},
+	"memcache.Set": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheSetRequest{}, &memcachepb.MemcacheSetResponse{}
+	},
+	"memcache.Delete": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheDeleteRequest{}, &memcachepb.MemcacheDeleteResponse{}
+	},
+	"memcache.Increment": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheIncrementRequest{}, &memcachepb.MemcacheIncrementResponse{}
+	},
+	"memcache.BatchIncrement": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheBatchIncrementRequest{}, &memcachepb.MemcacheBatchIncrementResponse{}
+	},
+	"memcache.FlushAll": func() (proto.Message, proto.Message) {
+		return &memcachepb.MemcacheFlushRequest{}, &memcachepb.MemcacheFlushResponse{}
+	},
+	"taskqueue.BulkAdd": func() (proto.Message, proto.Message) {
+		return &taskqueuepb.TaskQueueBulkAddRequest{}, &taskqueuepb.TaskQueueBulkAddResponse{}
+	},
+	"taskqueue.QueryAndOwnTasks": func() (proto.Message, proto.Message) {
+		return &taskqueuepb.TaskQueueQueryAndOwnTasksRequest{}, &taskqueuepb.TaskQueueQueryAndOwnTasksResponse{}
+	},
+	"taskqueue.ModifyTaskLease": func() (proto.Message, proto.Message) {
+		return &taskqueuepb.TaskQueueModifyTaskLeaseRequest{}, &taskqueuepb.TaskQueueModifyTaskLeaseResponse{}
+	},
+	"taskqueue.Delete": func() (proto.Message, proto.Message) {
+		return &taskqueuepb.TaskQueueDeleteRequest{}, &taskqueuepb.TaskQueueDeleteResponse{}
+	},
+	"taskqueue.PurgeQueue": func() (proto.Message, proto.Message) {
+		return &taskqueuepb.TaskQueuePurgeQueueRequest{}, &taskqueuepb.TaskQueuePurgeQueueResponse{}
+	},
+}
+
+// convert copies the message from into to, a message with the same wire
+// format.
+func convert(from, to proto.Message) error {
+	data, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+	to.Reset()
+	return proto.Unmarshal(data, to)
+}
@@ -0,0 +1,179 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// appConfigFiles are the application wide configuration files that
+// dev_appserver.py reads from the root of the first module.
+var appConfigFiles = []string{"queue.yaml", "cron.yaml", "dispatch.yaml", "dos.yaml", "index.yaml"}
+
+// configDir returns the directory holding the application's configuration
+// files, or "" if the application's own configuration isn't used.
+func (o *Options) configDir() string {
+	if o == nil {
+		return ""
+	}
+	if o.ConfigDir != "" {
+		return o.ConfigDir
+	}
+	if len(o.Modules) > 0 {
+		return filepath.Dir(o.Modules[0].Path)
+	}
+	return ""
+}
+
+// writeAppConfig writes the application wide configuration files into
+// fakeAppDir, which is the root of the first module the child starts.  The
+// application's own files in configDir are copied, with the queues from
+// Options merged into its queue.yaml and index.yaml taken from
+// indexYAMLPath if given.  dispatch.yaml is left out, with a warning, if it
+// routes to a module the child doesn't start, as dev_appserver.py would fail
+// to start.  It returns the paths that have to be given to dev_appserver.py
+// in addition to the module yaml files.
+func (c *Context) writeAppConfig() (params []string, err error) {
+	for _, name := range appConfigFiles {
+		var data []byte
+		src := ""
+		if c.configDir != "" {
+			src = filepath.Join(c.configDir, name)
+		}
+		if name == "index.yaml" && c.indexYAMLPath != "" {
+			src = c.indexYAMLPath
+		}
+		if src != "" {
+			data, err = ioutil.ReadFile(src)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		if name == "queue.yaml" && len(c.queues) > 0 {
+			if data, err = mergeQueueYAML(data, c.storageLimit, c.queues); err != nil {
+				return nil, fmt.Errorf("Error generating queue.yaml - %v", err)
+			}
+		}
+		if data == nil {
+			continue
+		}
+		if name == "dispatch.yaml" {
+			missing, err := c.missingDispatchModules(data)
+			if err != nil {
+				return nil, err
+			}
+			if len(missing) > 0 {
+				c.logf(LogWarning, "Not using %s, it routes to modules that aren't started: %s", src, strings.Join(missing, ", "))
+				continue
+			}
+		}
+		path := filepath.Join(c.fakeAppDir, name)
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			return nil, err
+		}
+		if name == "dispatch.yaml" {
+			params = append(params, path)
+		}
+	}
+	return params, nil
+}
+
+// missingDispatchModules returns the modules that the dispatch.yaml in data
+// routes to but that aren't among the Context's modules.
+func (c *Context) missingDispatchModules(data []byte) ([]string, error) {
+	var dispatch struct {
+		Dispatch []struct {
+			Module  string `yaml:"module"`
+			Service string `yaml:"service"`
+		} `yaml:"dispatch"`
+	}
+	if err := yaml.Unmarshal(data, &dispatch); err != nil {
+		return nil, fmt.Errorf("could not parse the application's dispatch.yaml - %v", err)
+	}
+	started := make(map[string]bool)
+	for _, m := range c.modules {
+		started[m.Name] = true
+	}
+	var missing []string
+	for _, rule := range dispatch.Dispatch {
+		name := rule.Module
+		if name == "" {
+			name = rule.Service
+		}
+		if name != "" && !started[name] {
+			started[name] = true // report it once
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// mergeQueueYAML adds queues to the application's queue.yaml in data.  Queues
+// the application already defines with the same name are replaced.  An empty
+// data gives a queue.yaml with only the configured queues.
+func mergeQueueYAML(data []byte, storageLimit string, queues []QueueConfig) ([]byte, error) {
+	var generated bytes.Buffer
+	if err := writeQueueYAML(&generated, storageLimit, queues); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return generated.Bytes(), nil
+	}
+	var app, gen yaml.MapSlice
+	if err := yaml.Unmarshal(data, &app); err != nil {
+		return nil, fmt.Errorf("could not parse the application's queue.yaml - %v", err)
+	}
+	if err := yaml.Unmarshal(generated.Bytes(), &gen); err != nil {
+		return nil, err
+	}
+	var genQueues []interface{}
+	for _, item := range gen {
+		if item.Key == "queue" {
+			genQueues, _ = item.Value.([]interface{})
+		}
+	}
+	found := false
+	for i, item := range app {
+		switch item.Key {
+		case "total_storage_limit":
+			if storageLimit != "" {
+				app[i].Value = storageLimit
+			}
+		case "queue":
+			found = true
+			appQueues, _ := item.Value.([]interface{})
+			configured := make(map[interface{}]bool)
+			for _, q := range genQueues {
+				configured[queueName(q)] = true
+			}
+			var merged []interface{}
+			for _, q := range appQueues {
+				if !configured[queueName(q)] {
+					merged = append(merged, q)
+				}
+			}
+			app[i].Value = append(merged, genQueues...)
+		}
+	}
+	if !found {
+		app = append(app, yaml.MapItem{Key: "queue", Value: genQueues})
+	}
+	return yaml.Marshal(app)
+}
+
+// queueName returns the name of a queue of a parsed queue.yaml.
+func queueName(q interface{}) interface{} {
+	if q, ok := q.(yaml.MapSlice); ok {
+		for _, field := range q {
+			if field.Key == "name" {
+				return field.Value
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"strings"
+)
+
+// managedFlags are the dev_appserver.py flags set through Options rather
+// than DevAppserverArgs.
+var managedFlags = map[string]string{
+	"--clear_datastore":              "Options.ClearDatastore",
+	"--require_indexes":              "Options.RequireIndexes",
+	"--datastore_consistency_policy": "Options.Consistency",
+	"--log_level":                    "Options.Debug",
+}
+
+// flagName returns the name of a --flag=value argument.
+func flagName(arg string) string {
+	if i := strings.Index(arg, "="); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
+
+func (o *Options) devAppserverArgs() ([]string, error) {
+	if o == nil {
+		return nil, nil
+	}
+	for _, arg := range o.DevAppserverArgs {
+		if !strings.HasPrefix(arg, "--") {
+			return nil, fmt.Errorf("DevAppserverArgs given %q, flags must be of the form --flag or --flag=value", arg)
+		}
+		if opt, ok := managedFlags[flagName(arg)]; ok {
+			return nil, fmt.Errorf("DevAppserverArgs given %s, use %s instead", flagName(arg), opt)
+		}
+	}
+	return o.DevAppserverArgs, nil
+}
+
+func (o *Options) env() ([]string, error) {
+	if o == nil {
+		return nil, nil
+	}
+	env := make([]string, 0, len(o.Env))
+	for k, v := range o.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, fmt.Errorf("Env given %q, not a valid environment variable name", k)
+		}
+		env = append(env, k+"="+v)
+	}
+	return env, nil
+}
+
+func (o *Options) clearDatastore() bool {
+	if o == nil || o.ClearDatastore == nil {
+		return true
+	}
+	return *o.ClearDatastore
+}
+
+// mergeArgs returns the defaults with the flags also given in args replaced,
+// followed by the rest of args.
+func mergeArgs(defaults, args []string) []string {
+	given := make(map[string]bool, len(args))
+	for _, arg := range args {
+		given[flagName(arg)] = true
+	}
+	merged := make([]string, 0, len(defaults)+len(args))
+	for _, arg := range defaults {
+		if !given[flagName(arg)] {
+			merged = append(merged, arg)
+		}
+	}
+	return append(merged, args...)
+}
@@ -0,0 +1,80 @@
+package appenginetesting
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// INFO     2015-06-01 12:00:00,123 module.py:812] default: "GET / HTTP/1.1" 200 2
+	childLineRegex = regexp.MustCompile(`^(DEBUG|INFO|WARNING|ERROR|CRITICAL)\s+(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d,\d{3}) (\S+?:\d+)\] (.*)$`)
+	// 2015/06/01 12:00:00 INFO: message, as written by the Go app instances
+	appLineRegex = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d) (DEBUG|INFO|WARNING|ERROR|CRITICAL): (.*)$`)
+	// default: "GET / HTTP/1.1" 200 2
+	moduleRegex    = regexp.MustCompile(`^([\w-]+): "[A-Z]+ \S+ HTTP/[\d.]+"`)
+	requestIDRegex = regexp.MustCompile(`(?i)\brequest[ _]?id[=: ]+([0-9a-f]+)`)
+)
+
+var childLevels = map[string]LogLevel{
+	"DEBUG":    LogDebug,
+	"INFO":     LogInfo,
+	"WARNING":  LogWarning,
+	"ERROR":    LogError,
+	"CRITICAL": LogCritical,
+}
+
+// childLogParser turns the output of dev_appserver.py into log entries.
+// Only the log lines of the application get their severity as level; the
+// lines of dev_appserver.py itself, like its request log, stay at LogChild so
+// that they are only written out at that LogLevel.  Lines without a
+// severity, like the rest of a traceback, continue the entry before them.
+type childLogParser struct {
+	last LogEntry
+}
+
+func (p *childLogParser) parse(line string) LogEntry {
+	e := LogEntry{Level: LogChild, Time: time.Now(), Message: line, Source: SourceChild}
+	if m := childLineRegex.FindStringSubmatch(line); m != nil {
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05.000", strings.Replace(m[2], ",", ".", 1), time.Local); err == nil {
+			e.Time = t
+		}
+		e.Message = m[4]
+		if mm := moduleRegex.FindStringSubmatch(e.Message); mm != nil {
+			e.Module = mm[1]
+		}
+	} else if m := appLineRegex.FindStringSubmatch(line); m != nil {
+		e.Level = childLevels[m[2]]
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local); err == nil {
+			e.Time = t
+		}
+		e.Message = m[3]
+		e.Module = p.last.Module
+		e.RequestID = p.last.RequestID
+	} else if p.last.Source == SourceChild {
+		e.Level = p.last.Level
+		e.Module = p.last.Module
+		e.RequestID = p.last.RequestID
+	}
+	if m := requestIDRegex.FindStringSubmatch(e.Message); m != nil {
+		e.RequestID = m[1]
+	}
+	p.last = e
+	return e
+}
+
+// logChildOutput emits every line read from r as a log entry, calling fn
+// with each raw line first.  It returns when r is exhausted.
+func (c *Context) logChildOutput(r io.Reader, fn func(line []byte)) error {
+	var p childLogParser
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		c.emit(p.parse(s.Text()))
+		if fn != nil {
+			fn(s.Bytes())
+		}
+	}
+	return s.Err()
+}
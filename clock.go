@@ -0,0 +1,312 @@
+package appenginetesting
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"appengine_internal"
+	memcachepb "appengine_internal/memcache"
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// memcacheRelativeLimit is the largest memcache expiration, in seconds, that
+// is treated as relative to the current time.  Larger values are absolute
+// unix timestamps.
+const memcacheRelativeLimit = 30 * 24 * 60 * 60
+
+// Clock is a controllable source of time for a Context.  A new Clock reads
+// the wall clock; Advance and Set shift it by an offset which then applies to
+// memcache expirations, task countdowns, pull queue leases and the jobs of the
+// application's cron.yaml.
+//
+// dev_appserver.py keeps using the wall clock, so the Context translates
+// memcache expirations into wall time when forwarding calls and, whenever the
+// Clock is moved, expires memcache items, runs due tasks and drops expired
+// leases in the child to match.  The appengine packages compute a task's ETA
+// from its Delay on the wall clock, and an explicit Task.ETA can't be told
+// apart from it, so Task.ETA is read on the wall clock too: set it from
+// time.Now(), not Clock.Now(); only Task.Delay follows the Clock.  dev_appserver.py doesn't run cron jobs at all; the
+// Context requests those whose schedule is due on the Clock's timeline, for
+// the schedules "every N minutes", "every N hours", "every day HH:MM" and
+// "every monday,friday HH:MM".  Other schedules are skipped with a warning.
+type Clock struct {
+	mu       sync.Mutex
+	offset   time.Duration
+	onChange func()
+}
+
+// Now returns the current time as seen by the Context.
+func (cl *Clock) Now() time.Time {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return time.Now().Add(cl.offset)
+}
+
+// Advance moves the clock forward by d.
+func (cl *Clock) Advance(d time.Duration) {
+	cl.mu.Lock()
+	cl.offset += d
+	cl.mu.Unlock()
+	cl.changed()
+}
+
+// Set moves the clock to t.  Time keeps running from t at the wall clock's
+// pace.
+func (cl *Clock) Set(t time.Time) {
+	cl.mu.Lock()
+	cl.offset = t.Sub(time.Now())
+	cl.mu.Unlock()
+	cl.changed()
+}
+
+// Offset returns the difference between the clock and the wall clock.
+func (cl *Clock) Offset() time.Duration {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.offset
+}
+
+func (cl *Clock) changed() {
+	if cl.onChange != nil {
+		cl.onChange()
+	}
+}
+
+// Clock returns the Context's controllable clock.
+//
+// Clock is not part of the appengine.Context interface.
+func (c *Context) Clock() *Clock {
+	return c.clock
+}
+
+// clockTask is a task in the child whose timing is controlled by the Clock.
+type clockTask struct {
+	queue, name string
+	due         time.Time // on the Clock's timeline
+	etaUsec     int64     // as stored by the child
+	leased      bool
+}
+
+func (t clockTask) id() string {
+	return t.queue + "\x00" + t.name
+}
+
+func memcacheID(namespace string, key []byte) string {
+	return namespace + "\x00" + string(key)
+}
+
+// clockBeforeCall translates the deadlines in a call from the Clock's
+// timeline into wall time before the call is forwarded to the child.
+func (c *Context) clockBeforeCall(service, method string, in appengine_internal.ProtoMessage) {
+	switch {
+	case service == "memcache" && method == "Set":
+		req, ok := in.(*memcachepb.MemcacheSetRequest)
+		if !ok {
+			return
+		}
+		c.expireMemcache()
+		now, offset := c.clock.Now(), c.clock.Offset()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, item := range req.Item {
+			id := memcacheID(req.GetNameSpace(), item.Key)
+			exp := item.GetExpirationTime()
+			if exp == 0 {
+				delete(c.memcacheExpiry, id)
+				continue
+			}
+			due := time.Unix(int64(exp), 0)
+			if exp <= memcacheRelativeLimit {
+				due = now.Add(time.Duration(exp) * time.Second)
+			}
+			c.memcacheExpiry[id] = due
+			item.ExpirationTime = proto.Uint32(uint32(due.Add(-offset).Unix()))
+		}
+	case service == "memcache" && method == "FlushAll":
+		c.mu.Lock()
+		c.memcacheExpiry = make(map[string]time.Time)
+		c.mu.Unlock()
+	case service == "memcache":
+		c.expireMemcache()
+	}
+}
+
+// clockAfterCall records the tasks and leases created by a successful call so
+// that they can follow the Clock.
+func (c *Context) clockAfterCall(service, method string, in, out appengine_internal.ProtoMessage) {
+	if service != "taskqueue" {
+		return
+	}
+	offset := c.clock.Offset()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneClockTasks()
+	switch method {
+	case "BulkAdd":
+		req, ok := in.(*taskqueuepb.TaskQueueBulkAddRequest)
+		res, ok2 := out.(*taskqueuepb.TaskQueueBulkAddResponse)
+		if !ok || !ok2 {
+			return
+		}
+		for i, add := range req.AddRequest {
+			if i >= len(res.Taskresult) || res.Taskresult[i].GetResult() != taskqueuepb.TaskQueueServiceError_OK {
+				continue
+			}
+			name := add.TaskName
+			if chosen := res.Taskresult[i].ChosenTaskName; chosen != nil {
+				name = chosen
+			}
+			// The SDK computes the ETA from the wall clock, so the
+			// countdown starts at the Clock's current time.
+			t := clockTask{
+				queue:   string(add.QueueName),
+				name:    string(name),
+				due:     time.Unix(0, add.GetEtaUsec()*1e3).Add(offset),
+				etaUsec: add.GetEtaUsec(),
+			}
+			c.clockTasks[t.id()] = t
+		}
+	case "QueryAndOwnTasks":
+		req, ok := in.(*taskqueuepb.TaskQueueQueryAndOwnTasksRequest)
+		res, ok2 := out.(*taskqueuepb.TaskQueueQueryAndOwnTasksResponse)
+		if !ok || !ok2 {
+			return
+		}
+		for _, task := range res.Task {
+			t := clockTask{
+				queue:   string(req.QueueName),
+				name:    string(task.TaskName),
+				due:     time.Unix(0, task.GetEtaUsec()*1e3).Add(offset),
+				etaUsec: task.GetEtaUsec(),
+				leased:  true,
+			}
+			c.clockTasks[t.id()] = t
+		}
+	case "ModifyTaskLease":
+		req, ok := in.(*taskqueuepb.TaskQueueModifyTaskLeaseRequest)
+		res, ok2 := out.(*taskqueuepb.TaskQueueModifyTaskLeaseResponse)
+		if !ok || !ok2 {
+			return
+		}
+		t := clockTask{
+			queue:   string(req.QueueName),
+			name:    string(req.TaskName),
+			due:     time.Unix(0, res.GetUpdatedEtaUsec()*1e3).Add(offset),
+			etaUsec: res.GetUpdatedEtaUsec(),
+			leased:  true,
+		}
+		c.clockTasks[t.id()] = t
+	case "Delete":
+		req, ok := in.(*taskqueuepb.TaskQueueDeleteRequest)
+		if !ok {
+			return
+		}
+		for _, name := range req.TaskName {
+			delete(c.clockTasks, clockTask{queue: string(req.QueueName), name: string(name)}.id())
+		}
+	case "PurgeQueue":
+		req, ok := in.(*taskqueuepb.TaskQueuePurgeQueueRequest)
+		if !ok {
+			return
+		}
+		for id, t := range c.clockTasks {
+			if t.queue == string(req.QueueName) {
+				delete(c.clockTasks, id)
+			}
+		}
+	}
+}
+
+// clockChanged brings the child in line with the Clock after it has been
+// moved.
+func (c *Context) clockChanged() {
+	c.expireMemcache()
+	c.runDueTasks()
+	c.runDueCron()
+}
+
+// pruneClockTasks forgets the tasks whose ETA has passed on the wall clock,
+// as the child has run them or let their lease expire by itself.  c.mu must
+// be held.
+func (c *Context) pruneClockTasks() {
+	now := time.Now().UnixNano() / 1e3
+	for id, t := range c.clockTasks {
+		if t.etaUsec <= now {
+			delete(c.clockTasks, id)
+		}
+	}
+}
+
+// expireMemcache deletes the memcache items whose expiration has passed on the
+// Clock's timeline but not yet on the wall clock.
+func (c *Context) expireMemcache() {
+	now := c.clock.Now()
+	expired := make(map[string][][]byte)
+	c.mu.Lock()
+	for id, due := range c.memcacheExpiry {
+		if now.Before(due) {
+			continue
+		}
+		delete(c.memcacheExpiry, id)
+		for i := 0; i < len(id); i++ {
+			if id[i] == 0 {
+				expired[id[:i]] = append(expired[id[:i]], []byte(id[i+1:]))
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	for namespace, keys := range expired {
+		req := &memcachepb.MemcacheDeleteRequest{}
+		if namespace != "" {
+			req.NameSpace = proto.String(namespace)
+		}
+		for _, key := range keys {
+			req.Item = append(req.Item, &memcachepb.MemcacheDeleteRequest_Item{Key: key})
+		}
+		if err := c.call("memcache", "Delete", req, &memcachepb.MemcacheDeleteResponse{}); err != nil {
+			c.logf(LogWarning, "Could not expire memcache items - %v", err)
+		}
+	}
+}
+
+// runDueTasks runs the push tasks and drops the leases that are due on the
+// Clock's timeline.
+func (c *Context) runDueTasks() {
+	now := c.clock.Now()
+	var due []clockTask
+	c.mu.Lock()
+	c.pruneClockTasks()
+	for id, t := range c.clockTasks {
+		if now.Before(t.due) {
+			continue
+		}
+		delete(c.clockTasks, id)
+		due = append(due, t)
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		var err error
+		if t.leased {
+			err = c.call("taskqueue", "ModifyTaskLease", &taskqueuepb.TaskQueueModifyTaskLeaseRequest{
+				QueueName:    []byte(t.queue),
+				TaskName:     []byte(t.name),
+				EtaUsec:      proto.Int64(t.etaUsec),
+				LeaseSeconds: proto.Float64(0),
+			}, &taskqueuepb.TaskQueueModifyTaskLeaseResponse{})
+		} else {
+			err = c.call("taskqueue", "ForceRun", &taskqueuepb.TaskQueueForceRunRequest{
+				AppId:     []byte(c.FullyQualifiedAppID()),
+				QueueName: []byte(t.queue),
+				TaskName:  []byte(t.name),
+			}, &taskqueuepb.TaskQueueForceRunResponse{})
+		}
+		if err != nil {
+			// The task may have been run, leased or deleted by the
+			// application in the meantime.
+			c.logf(LogDebug, "Could not advance task %s in queue %s - %v", t.name, t.queue, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package appenginetesting
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFileName is the optional configuration file looked up in the current
+// working directory and its parents.
+const ConfigFileName = "appenginetesting.yaml"
+
+const defaultStartupTimeout = 15 * time.Second
+
+// Using -loglevel on the command line temporarily overrides the options in NewContext.
+// The flag is parsed by go test; it is looked up by every NewContext, so a
+// Context created in TestMain before flag.Parse doesn't see it.
+var overrideLogLevel = flag.String("loglevel", "", "[appenginetesting] forces all tests to have LogLevel of one of the following: child,debug,info,warning,error,critical")
+
+// config holds the settings that apply to every Context of a test run.  They
+// come from, in decreasing order of precedence:
+//
+//	the -loglevel flag (log level only)
+//	APPENGINETESTING_* environment variables
+//	appenginetesting.yaml, or the file named by APPENGINETESTING_CONFIG
+//
+// Settings that are also in Options override the values given in Options,
+// except for Options.PythonPath, which overrides python_path and
+// APPENGINETESTING_PYTHON.
+type config struct {
+	LogLevel       string        `yaml:"log_level"`       // APPENGINETESTING_LOGLEVEL
+	SDKPath        string        `yaml:"sdk_path"`        // APPENGINETESTING_SDK, dev_appserver.py or its directory
+	PythonPath     string        `yaml:"python_path"`     // APPENGINETESTING_PYTHON
+	StartupTimeout time.Duration `yaml:"startup_timeout"` // APPENGINETESTING_STARTUP_TIMEOUT, e.g. "30s"
+	KeepTempDir    bool          `yaml:"keep_temp_dir"`   // APPENGINETESTING_KEEP_TEMP_DIR, keep fakeAppDir on Close
+	Backend        string        `yaml:"backend"`         // APPENGINETESTING_BACKEND, only "dev_appserver" for now
+	UpdateGolden   bool          `yaml:"update_golden"`   // APPENGINETESTING_UPDATE, rewrite golden files like -update
+}
+
+var (
+	configOnce   sync.Once
+	loadedConfig *config
+	configErr    error
+)
+
+// loadConfig returns the configuration of the test run.  The environment and
+// config file are read on first use, the -loglevel flag on every call.
+func loadConfig() (*config, error) {
+	configOnce.Do(func() {
+		loadedConfig, configErr = readConfig()
+	})
+	if configErr != nil {
+		return nil, configErr
+	}
+	cfg := *loadedConfig
+	if *overrideLogLevel != "" {
+		if _, err := parseLogLevel(*overrideLogLevel); err != nil {
+			return nil, err
+		}
+		cfg.LogLevel = *overrideLogLevel
+	}
+	return &cfg, nil
+}
+
+func readConfig() (*config, error) {
+	cfg := &config{}
+	path := os.Getenv("APPENGINETESTING_CONFIG")
+	if path == "" {
+		path = findConfigFile()
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("[appenginetesting] could not read config file - %v", err)
+		}
+		if err = yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("[appenginetesting] could not parse config file %s - %v", path, err)
+		}
+	}
+
+	if v := os.Getenv("APPENGINETESTING_LOGLEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv("APPENGINETESTING_SDK"); v != "" {
+		cfg.SDKPath = v
+	}
+	if v := os.Getenv("APPENGINETESTING_PYTHON"); v != "" {
+		cfg.PythonPath = v
+	}
+	if v := os.Getenv("APPENGINETESTING_STARTUP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("[appenginetesting] APPENGINETESTING_STARTUP_TIMEOUT given %s, not a valid duration", v)
+		}
+		cfg.StartupTimeout = d
+	}
+	if v := os.Getenv("APPENGINETESTING_KEEP_TEMP_DIR"); v != "" {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("[appenginetesting] APPENGINETESTING_KEEP_TEMP_DIR given %s, not a valid boolean", v)
+		}
+		cfg.KeepTempDir = keep
+	}
+	if v := os.Getenv("APPENGINETESTING_UPDATE"); v != "" {
+		update, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("[appenginetesting] APPENGINETESTING_UPDATE given %s, not a valid boolean", v)
+		}
+		cfg.UpdateGolden = update
+	}
+	if v := os.Getenv("APPENGINETESTING_BACKEND"); v != "" {
+		cfg.Backend = v
+	}
+	if cfg.LogLevel != "" {
+		if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.Backend {
+	case "", "dev_appserver":
+	default:
+		return nil, fmt.Errorf("[appenginetesting] backend given %s, not a valid option, use dev_appserver", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+// startupTimeout returns the configured startup timeout, or else the one of
+// Options, or else the default.
+func (cfg *config) startupTimeout(opts time.Duration) time.Duration {
+	switch {
+	case cfg.StartupTimeout > 0:
+		return cfg.StartupTimeout
+	case opts > 0:
+		return opts
+	}
+	return defaultStartupTimeout
+}
+
+// findConfigFile returns the path of ConfigFileName in the working directory
+// or the closest of its parents, or "" if there is none.
+func findConfigFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ConfigFileName)
+		if fileExists(path) {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	for ll := LogChild; ll <= LogCritical; ll++ {
+		if ll.String() == s {
+			return ll, nil
+		}
+	}
+	return 0, fmt.Errorf("[appenginetesting] loglevel given %s, not a valid option, use one of child, debug, info, warning, error, or critical.", s)
+}
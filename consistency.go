@@ -0,0 +1,203 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+
+	"appengine_internal"
+	datastorepb "appengine_internal/datastore"
+)
+
+// Datastore consistency policies for Consistency.Policy.
+const (
+	// ConsistencyStrong makes every write visible to queries at once.
+	ConsistencyStrong = "consistent"
+	// ConsistencyRandom applies writes to non-ancestor queries at random.
+	ConsistencyRandom = "random"
+	// ConsistencyTime applies writes to non-ancestor queries after a short
+	// delay; dev_appserver.py's default.
+	ConsistencyTime = "time"
+)
+
+// Consistency controls how the datastore simulates the eventual consistency of
+// non-ancestor queries in the High Replication Datastore.
+//
+// The simulation of ConsistencyRandom with a Probability only hides the
+// entities that a Put creates; updates are seen at once, with their new
+// values.  Counts and query offsets are computed by the datastore, and don't
+// take the hidden entities into account.
+type Consistency struct {
+	Policy string
+	// Probability that a query sees a write not yet applied, for
+	// ConsistencyRandom.  If set, the simulation runs in the Context, using
+	// Seed, so that a failing test can be repeated; otherwise dev_appserver.py
+	// decides at random.
+	Probability float64
+	Seed        int64
+}
+
+func (cs *Consistency) validate() error {
+	switch cs.Policy {
+	case ConsistencyStrong, ConsistencyTime:
+		if cs.Probability != 0 {
+			return fmt.Errorf("Consistency.Probability is only supported with ConsistencyRandom")
+		}
+	case ConsistencyRandom:
+		if cs.Probability < 0 || cs.Probability > 1 {
+			return fmt.Errorf("Consistency.Probability given %v, must be between 0 and 1", cs.Probability)
+		}
+	default:
+		return fmt.Errorf("Consistency.Policy given %s, not a valid option, use one of %s, %s or %s", cs.Policy, ConsistencyStrong, ConsistencyRandom, ConsistencyTime)
+	}
+	return nil
+}
+
+// childPolicy returns the --datastore_consistency_policy for the child.
+func (cs *Consistency) childPolicy() string {
+	if cs.inProcess() {
+		return ConsistencyStrong
+	}
+	return cs.Policy
+}
+
+func (cs *Consistency) inProcess() bool {
+	return cs.Policy == ConsistencyRandom && cs.Probability > 0
+}
+
+// consistencySim hides new entities from non-ancestor queries until they are
+// applied.  A write is applied the first time a query sees it, which happens
+// with the configured probability, or when its entity is read by key or by an
+// ancestor query.
+type consistencySim struct {
+	rand        *rand.Rand
+	probability float64
+	unapplied   map[string]bool // keys of entities created but not applied yet
+	global      map[uint64]bool // cursors of non-ancestor queries with more results
+}
+
+func newConsistencySim(cs *Consistency) *consistencySim {
+	return &consistencySim{
+		rand:        rand.New(rand.NewSource(cs.Seed)),
+		probability: cs.Probability,
+		unapplied:   make(map[string]bool),
+		global:      make(map[uint64]bool),
+	}
+}
+
+func referenceID(r *datastorepb.Reference) string {
+	var buf bytes.Buffer
+	buf.WriteString(r.GetNameSpace())
+	for _, e := range r.GetPath().GetElement() {
+		fmt.Fprintf(&buf, "/%s,%d,%q", e.GetType(), e.GetId(), e.GetName())
+	}
+	return buf.String()
+}
+
+// consistencyBeforeCall returns the keys of a datastore Put that are already
+// in the datastore.  Production returns their previous versions to the
+// queries that don't see the update yet, so the simulation doesn't hide them.
+func (c *Context) consistencyBeforeCall(service, method string, in appengine_internal.ProtoMessage) map[string]bool {
+	if c.consistency == nil || service != "datastore_v3" || method != "Put" {
+		return nil
+	}
+	req, ok := in.(*datastorepb.PutRequest)
+	if !ok {
+		return nil
+	}
+	get := &datastorepb.GetRequest{}
+	for _, e := range req.Entity {
+		path := e.GetKey().GetPath().GetElement()
+		if len(path) == 0 {
+			continue
+		}
+		if last := path[len(path)-1]; last.GetId() != 0 || last.GetName() != "" {
+			get.Key = append(get.Key, e.Key)
+		}
+	}
+	existing := make(map[string]bool)
+	if len(get.Key) == 0 {
+		return existing
+	}
+	res := &datastorepb.GetResponse{}
+	if err := c.call("datastore_v3", "Get", get, res); err != nil {
+		c.logf(LogWarning, "Could not check the entities of a Put for the consistency simulation - %v", err)
+		return existing
+	}
+	for _, e := range res.Entity {
+		if e.Entity != nil {
+			existing[referenceID(e.Entity.Key)] = true
+		}
+	}
+	return existing
+}
+
+// consistencyAfterCall applies the simulation to a successful datastore call,
+// given the keys that already existed before a Put.
+func (c *Context) consistencyAfterCall(service, method string, in, out appengine_internal.ProtoMessage, existing map[string]bool) {
+	if c.consistency == nil || service != "datastore_v3" {
+		return
+	}
+	sim := c.consistency
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "Put":
+		if res, ok := out.(*datastorepb.PutResponse); ok {
+			for _, k := range res.Key {
+				if id := referenceID(k); !existing[id] {
+					sim.unapplied[id] = true
+				}
+			}
+		}
+	case "Get":
+		if req, ok := in.(*datastorepb.GetRequest); ok {
+			for _, k := range req.Key {
+				delete(sim.unapplied, referenceID(k))
+			}
+		}
+	case "Delete":
+		if req, ok := in.(*datastorepb.DeleteRequest); ok {
+			for _, k := range req.Key {
+				delete(sim.unapplied, referenceID(k))
+			}
+		}
+	case "RunQuery":
+		req, ok := in.(*datastorepb.Query)
+		res, ok2 := out.(*datastorepb.QueryResult)
+		if !ok || !ok2 {
+			return
+		}
+		global := req.Ancestor == nil
+		if global && res.Cursor != nil && res.GetMoreResults() {
+			sim.global[res.Cursor.GetCursor()] = true
+		}
+		sim.filter(res, global)
+	case "Next":
+		req, ok := in.(*datastorepb.NextRequest)
+		res, ok2 := out.(*datastorepb.QueryResult)
+		if !ok || !ok2 {
+			return
+		}
+		cursor := req.GetCursor().GetCursor()
+		sim.filter(res, sim.global[cursor])
+		if !res.GetMoreResults() {
+			delete(sim.global, cursor)
+		}
+	}
+}
+
+// filter drops the unapplied writes from the results of a global query, and
+// applies every write seen by a query.
+func (sim *consistencySim) filter(res *datastorepb.QueryResult, global bool) {
+	kept := res.Result[:0]
+	for _, e := range res.Result {
+		id := referenceID(e.GetKey())
+		if global && sim.unapplied[id] && sim.rand.Float64() >= sim.probability {
+			continue
+		}
+		delete(sim.unapplied, id)
+		kept = append(kept, e)
+	}
+	res.Result = kept
+}
@@ -0,0 +1,159 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"appengine/datastore"
+	"appengine_internal"
+	basepb "appengine_internal/base"
+	datastorepb "appengine_internal/datastore"
+)
+
+// contention is the simulated contention on an entity group.
+type contention struct {
+	times   int // commits left to fail
+	every   int // fail every nth commit, if not 0
+	commits int // commits touching the group, for every
+}
+
+// ContendEntityGroup makes the next times commits of transactions touching
+// the entity group of key fail with datastore.ErrConcurrentTransaction, as if
+// another request had written to the group first.  It is meant for testing
+// the retries of datastore.RunInTransaction, which gives up after three
+// attempts by default.  A times of 0 stops the contention.
+//
+// ContendEntityGroup is not part of the appengine.Context interface.
+func (c *Context) ContendEntityGroup(key *datastore.Key, times int) {
+	c.contend(key, func(cn *contention) { cn.times = times })
+}
+
+// ContendEntityGroupEvery makes every nth commit of a transaction touching the
+// entity group of key fail with datastore.ErrConcurrentTransaction, counting
+// from now.  An n of 0 stops the contention.
+//
+// ContendEntityGroupEvery is not part of the appengine.Context interface.
+func (c *Context) ContendEntityGroupEvery(key *datastore.Key, n int) {
+	c.contend(key, func(cn *contention) { cn.every, cn.commits = n, 0 })
+}
+
+func (c *Context) contend(key *datastore.Key, set func(*contention)) {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	group := keyID(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.contention == nil {
+		c.contention = make(map[string]*contention)
+		c.txGroups = make(map[uint64]map[string]bool)
+	}
+	cn := c.contention[group]
+	if cn == nil {
+		cn = &contention{}
+		c.contention[group] = cn
+	}
+	set(cn)
+	if cn.times <= 0 && cn.every <= 0 {
+		delete(c.contention, group)
+	}
+}
+
+// referenceGroup returns the keyID of the root of r, or "" if the root is
+// incomplete and so a new entity group.
+func referenceGroup(r *datastorepb.Reference) string {
+	elems := r.GetPath().GetElement()
+	if len(elems) == 0 {
+		return ""
+	}
+	root := elems[0]
+	switch {
+	case root.GetName() != "":
+		return entityID(r.GetNameSpace(), fmt.Sprintf("%s,%q", root.GetType(), root.GetName()))
+	case root.GetId() != 0:
+		return entityID(r.GetNameSpace(), fmt.Sprintf("%s,%d", root.GetType(), root.GetId()))
+	}
+	return ""
+}
+
+// contentionBeforeCall records the entity groups touched by each transaction
+// and fails the commits of the contended ones.
+func (c *Context) contentionBeforeCall(service, method string, in appengine_internal.ProtoMessage) error {
+	if service != "datastore_v3" {
+		return nil
+	}
+	c.mu.Lock()
+	if c.contention == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	var tx *datastorepb.Transaction
+	var refs []*datastorepb.Reference
+	var contended []string
+	switch req := in.(type) {
+	case *datastorepb.GetRequest:
+		tx, refs = req.Transaction, req.Key
+	case *datastorepb.PutRequest:
+		tx = req.Transaction
+		for _, e := range req.Entity {
+			refs = append(refs, e.GetKey())
+		}
+	case *datastorepb.DeleteRequest:
+		tx, refs = req.Transaction, req.Key
+	case *datastorepb.Query:
+		tx = req.Transaction
+		if req.Ancestor != nil {
+			refs = append(refs, req.Ancestor)
+		}
+	case *datastorepb.Transaction:
+		if method != "Commit" && method != "Rollback" {
+			break
+		}
+		groups := c.txGroups[req.GetHandle()]
+		delete(c.txGroups, req.GetHandle())
+		if method == "Rollback" {
+			break
+		}
+		for group := range groups {
+			cn := c.contention[group]
+			if cn == nil {
+				continue
+			}
+			cn.commits++
+			switch {
+			case cn.times > 0:
+				cn.times--
+			case cn.every > 0 && cn.commits%cn.every == 0:
+			default:
+				continue
+			}
+			contended = append(contended, group)
+		}
+	}
+	if tx != nil {
+		groups := c.txGroups[tx.GetHandle()]
+		if groups == nil {
+			groups = make(map[string]bool)
+			c.txGroups[tx.GetHandle()] = groups
+		}
+		for _, r := range refs {
+			if group := referenceGroup(r); group != "" {
+				groups[group] = true
+			}
+		}
+	}
+	c.mu.Unlock()
+	if len(contended) == 0 {
+		return nil
+	}
+	sort.Strings(contended)
+	// release the transaction in the child, as a failed commit would
+	c.call(service, "Rollback", in, &basepb.VoidProto{})
+	c.logf(LogDebug, "Simulating contention on entity group %s", strings.Join(contended, ", "))
+	return &appengine_internal.APIError{
+		Service: service,
+		Detail:  "simulated contention on entity group " + strings.Join(contended, ", "),
+		Code:    int32(datastorepb.Error_CONCURRENT_TRANSACTION),
+	}
+}
@@ -9,10 +9,8 @@
 package appenginetesting
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
-	"flag"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -25,13 +23,16 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 
 	"appengine"
+	"appengine/datastore"
 	"appengine/user"
 	"appengine_internal"
 	basepb "appengine_internal/base"
@@ -51,27 +52,59 @@ var httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEn
 const AppServerFileName = "dev_appserver.py"
 const aeFakeName = "appenginetestingfake"
 
-// Using -loglevel on the command line temporarily overrides the options in NewContext
-var overrideLogLevel = flag.String("loglevel", "", "[appenginetesting] forces all tests to have LogLevel of one of the following: child,debug,info,warning,error,critical")
-
-func init() {
-	flag.Parse()
-}
+// closeGrace is how long Close waits for the child to exit before it
+// escalates from SIGTERM to SIGKILL.
+const closeGrace = 5 * time.Second
 
 // Context implements appengine.Context by running a dev_appserver.py
 // process as a child and proxying all Context calls to the child.
 // Use NewContext to create one.
 type Context struct {
-	appid      string
-	req        *http.Request
-	child      *exec.Cmd
-	testingURL string   // URL of "stub" module to send requests to
-	fakeAppDir string   // temp dir for application files
-	queues     []string // list of queues to support
-	debug      LogLevel // send the output of the application to console
-	testing    *testing.T
-	wroteToLog bool           // used in TestLogging
-	modules    []ModuleConfig // list of the modules that should start up on each test
+	appid          string
+	req            *http.Request
+	child          *exec.Cmd
+	testingURL     string        // URL of "stub" module to send requests to
+	fakeAppDir     string        // temp dir for application files
+	queues         []QueueConfig // list of queues to support
+	storageLimit   string        // total_storage_limit of queue.yaml
+	configDir      string        // directory of the application's queue.yaml, cron.yaml, etc.
+	indexYAMLPath  string        // project's index.yaml to merge the generated indexes into
+	requireIndexes bool          // fail queries that need an index missing from index.yaml
+	dsConsistency  string        // --datastore_consistency_policy of the child, if set
+	clearDatastore bool          // start the child with an empty datastore
+	childArgs      []string      // extra dev_appserver.py flags
+	childEnv       []string      // extra environment of the child, as KEY=value
+	pythonPath     string        // Options.PythonPath
+	sdkVersion     string        // release of the SDK running the child
+	startupTimeout time.Duration // Options.StartupTimeout
+	output         *outputTail   // last lines of the child's output
+	exited         chan struct{} // closed when the child exits
+	keepTempDir    bool          // leave fakeAppDir behind on Close
+	debug          LogLevel      // send the output of the application to console
+	testing        *testing.T
+	modules        []ModuleConfig // list of the modules that should start up on each test
+	clock          *Clock         // time seen by memcache expirations, tasks and leases
+
+	mu             sync.Mutex                 // guards the fields below
+	memcacheExpiry map[string]time.Time       // memcache item expirations on the clock's timeline
+	clockTasks     map[string]clockTask       // tasks and leases that follow the clock
+	cronJobs       []*cronJob                 // cron.yaml jobs that follow the clock
+	moduleURLs     map[string]string          // URL of each started module by name
+	fixtureKeys    map[string]*datastore.Key  // keys of the fixtures loaded by ref
+	consistency    *consistencySim            // in-process eventual consistency, if any
+	contention     map[string]*contention     // simulated contention by entity group
+	txGroups       map[uint64]map[string]bool // entity groups touched by each transaction
+	running        bool                       // the child started and Close was not called
+	childExit      *ErrChildExited            // why the child crashed, if it did
+
+	closeOnce sync.Once // Close runs once
+	closeErr  error     // result of Close
+
+	logMu      sync.Mutex // guards the fields below
+	logs       []LogEntry // everything logged by the Context and the child
+	wroteToLog bool       // used in TestLogging
+	detached   bool       // the test may have returned, see detachLog
+	testDone   bool       // the test of testing has returned
 }
 
 type ModuleConfig struct {
@@ -84,14 +117,25 @@ func (c *Context) AppID() string {
 }
 
 func (c *Context) logf(level LogLevel, format string, args ...interface{}) {
-	if c.debug > level {
+	c.emit(LogEntry{Level: level, Time: time.Now(), Message: fmt.Sprintf(format, args...), Source: SourceContext})
+}
+
+// emit records e and writes it out if the Context's LogLevel allows.
+func (c *Context) emit(e LogEntry) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.record(e)
+	if c.debug > e.Level {
 		return
 	}
-	s := fmt.Sprintf("%s\t%s", level, fmt.Sprintf(format, args...))
-	if c.testing == nil {
+	s := fmt.Sprintf("%s\t%s", e.Level, e.Message)
+	if e.Module != "" {
+		s = fmt.Sprintf("%s\t[%s] %s", e.Level, e.Module, e.Message)
+	}
+	if c.testing == nil || c.detached {
 		log.Println(s)
 	} else {
-		c.testing.Logf(s)
+		c.testing.Log(s)
 	}
 	c.wroteToLog = true // set if something was logged to support TestLogging unit test
 }
@@ -178,6 +222,26 @@ func (c *Context) Logout() {
 }
 
 func (c *Context) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return c.apiCall(service, method, in, out, true)
+}
+
+// internalContext is the Context as used by appenginetesting itself, to
+// inspect the datastore without the simulated clock, consistency and
+// contention applying to its calls.
+type internalContext struct {
+	*Context
+}
+
+func (ic internalContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return ic.apiCall(service, method, in, out, false)
+}
+
+// apiCall makes an API call of the Context, through the simulations if
+// simulate is set.
+func (c *Context) apiCall(service, method string, in, out appengine_internal.ProtoMessage, simulate bool) error {
+	if err := c.childExited(); err != nil {
+		return err
+	}
 	if service == "__go__" {
 		if method == "GetNamespace" {
 			out.(*basepb.StringProto).Value = proto.String(c.req.Header.Get("X-AppEngine-Current-Namespace"))
@@ -194,6 +258,24 @@ func (c *Context) Call(service, method string, in, out appengine_internal.ProtoM
 			mod(in, cn)
 		}
 	}
+	if !simulate {
+		return c.call(service, method, in, out)
+	}
+	if err := c.contentionBeforeCall(service, method, in); err != nil {
+		return err
+	}
+	c.clockBeforeCall(service, method, in)
+	existing := c.consistencyBeforeCall(service, method, in)
+	if err := c.call(service, method, in, out); err != nil {
+		return err
+	}
+	c.clockAfterCall(service, method, in, out)
+	c.consistencyAfterCall(service, method, in, out, existing)
+	return nil
+}
+
+// call forwards an API call to the child as is.
+func (c *Context) call(service, method string, in, out appengine_internal.ProtoMessage) error {
 	data, err := proto.Marshal(in)
 	if err != nil {
 		return err
@@ -203,10 +285,13 @@ func (c *Context) Call(service, method string, in, out appengine_internal.ProtoM
 		bytes.NewBuffer(data))
 	res, err := httpClient.Do(req)
 	if err != nil {
-		return err
+		return c.callError(err)
 	}
 	if res.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(res.Body)
+		if err := missingIndexError(service, body); err != nil {
+			return err
+		}
 		return fmt.Errorf("got status %d; body: %q", res.StatusCode, body)
 	}
 	pbytes, err := ioutil.ReadAll(res.Body)
@@ -226,34 +311,138 @@ func (c *Context) Request() interface{} {
 	return c.req
 }
 
-// Close kills the child dev_appserver.py process, releasing its
-// resources.
+// Close terminates the child dev_appserver.py process and the app
+// instances it started, releasing their resources.  They are sent SIGTERM
+// first, and SIGKILL if still running after a grace period.  If
+// Options.IndexYAMLPath was given, the indexes generated by the child are
+// merged into that file; a test that doesn't call Close leaves it as it is.
+// If the child can't be stopped, Close returns the error and leaves the
+// application files in place for the processes still using them.  Close may
+// be called more than once, and concurrently; the later calls return the
+// result of the first.
 //
 // Close is not part of the appengine.Context interface.
-func (c *Context) Close() {
-	if c == nil || c.child == nil {
-		return
+func (c *Context) Close() error {
+	if c == nil {
+		return nil
 	}
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *Context) close() error {
+	if c.child == nil {
+		return nil
+	}
+	var err error
 	defer func() {
-		os.RemoveAll(c.fakeAppDir)
+		switch {
+		case err != nil:
+			// the child may still be using them
+			c.logf(LogWarning, "Keeping application files in %s as devappserver may still be running", c.fakeAppDir)
+		case c.keepTempDir:
+			c.logf(LogInfo, "Keeping application files in %s", c.fakeAppDir)
+		default:
+			os.RemoveAll(c.fakeAppDir)
+		}
+		c.detachLog()
 	}()
+	c.mu.Lock()
+	c.running = false
+	c.mu.Unlock()
 	if p := c.child.Process; p != nil {
-		p.Signal(syscall.SIGTERM)
-		if _, err := p.Wait(); err != nil {
-			log.Fatalf("Error closing devappserver - %v", err)
-		}
+		err = c.terminateChild(p)
 	}
+	c.collectIndexes()
 	c.child = nil
+	return err
+}
+
+// terminateChild sends SIGTERM to the process group of the child, then
+// SIGKILL to whatever is left of it after closeGrace.
+func (c *Context) terminateChild(p *os.Process) error {
+	if err := terminateGroup(p); err != nil {
+		c.logf(LogWarning, "Error closing devappserver - %v", err)
+		return c.killChild(p)
+	}
+	deadline := time.After(closeGrace)
+	select {
+	case <-c.exited:
+		// the app instances may take a little longer
+		for groupAlive(p.Pid) {
+			select {
+			case <-deadline:
+				return c.killChild(p)
+			case <-time.After(probeMinBackoff):
+			}
+		}
+		return nil
+	case <-deadline:
+		return c.killChild(p)
+	}
+}
+
+func (c *Context) killChild(p *os.Process) error {
+	c.logf(LogWarning, "devappserver still running %s after SIGTERM, sending SIGKILL", closeGrace)
+	if err := killGroup(p); err != nil {
+		return fmt.Errorf("Error killing devappserver - %v", err)
+	}
+	select {
+	case <-c.exited:
+		return nil
+	case <-time.After(closeGrace):
+		return fmt.Errorf("devappserver (pid %d) still running after SIGKILL", p.Pid)
+	}
 }
 
 // Options control optional behavior for NewContext.
 type Options struct {
 	// AppId to pretend to be. By default, "testapp"
-	AppId      string // Required if using any Modules
-	TaskQueues []string
-	Debug      LogLevel
-	Testing    *testing.T
-	Modules    []ModuleConfig
+	AppId      string   // Required if using any Modules
+	TaskQueues []string // push queues with the default settings, kept for compatibility with Queues
+	PullQueues []string // pull queues with the default settings
+	Queues     []QueueConfig
+	// QueueStorageLimit is the total_storage_limit of queue.yaml. By default, "120M"
+	QueueStorageLimit string
+	Debug             LogLevel
+	Testing           *testing.T
+	Modules           []ModuleConfig
+	// ConfigDir holds the application's queue.yaml, cron.yaml, dispatch.yaml,
+	// dos.yaml and index.yaml. By default, the directory of the first module's
+	// yaml file. Queues are merged into the application's queue.yaml,
+	// replacing the queues it defines with the same name. dispatch.yaml is
+	// only used if every module it routes to is in Modules.
+	ConfigDir string
+	// IndexYAMLPath is the project's index.yaml. If set, the indexes the
+	// datastore generates for the queries of a test are added to it by
+	// Context.Close, which has to be called for the merge to happen.
+	IndexYAMLPath string
+	// RequireIndexes fails queries that need a composite index missing from
+	// the project's index.yaml, IndexYAMLPath or the one in ConfigDir, with a
+	// *MissingIndexError, as they would in production.
+	RequireIndexes bool
+	// Consistency of non-ancestor datastore queries. By default, writes are
+	// applied after a short delay, see ConsistencyTime.
+	Consistency *Consistency
+	// DevAppserverArgs are extra dev_appserver.py flags, like
+	// "--enable_sendmail" or "--smtp_host=localhost", replacing the defaults
+	// with the same name. Flags with an Options equivalent are rejected.
+	DevAppserverArgs []string
+	// Env adds variables to the environment of dev_appserver.py.
+	Env map[string]string
+	// ClearDatastore starts dev_appserver.py with an empty datastore. By
+	// default, true; set it to false to keep the data of --datastore_path.
+	ClearDatastore *bool
+	// PythonPath is the python 2.7 interpreter running dev_appserver.py. It
+	// takes precedence over APPENGINETESTING_PYTHON and python_path. By
+	// default, the configured one, CLOUDSDK_PYTHON or the first of python2.7
+	// and python in PATH.
+	PythonPath string
+	// StartupTimeout is how long dev_appserver.py may take to start every
+	// module, if not configured otherwise. By default, 15 seconds.
+	StartupTimeout time.Duration
 }
 
 func (o *Options) appId() string {
@@ -263,11 +452,25 @@ func (o *Options) appId() string {
 	return o.AppId
 }
 
-func (o *Options) taskQueues() []string {
-	if o == nil || len(o.TaskQueues) == 0 {
-		return []string{}
+func (o *Options) queues() []QueueConfig {
+	if o == nil {
+		return []QueueConfig{}
+	}
+	queues := make([]QueueConfig, 0, len(o.TaskQueues)+len(o.PullQueues)+len(o.Queues))
+	for _, name := range o.TaskQueues {
+		queues = append(queues, QueueConfig{Name: name})
+	}
+	for _, name := range o.PullQueues {
+		queues = append(queues, QueueConfig{Name: name, Mode: "pull"})
+	}
+	return append(queues, o.Queues...)
+}
+
+func (o *Options) queueStorageLimit() string {
+	if o == nil {
+		return ""
 	}
-	return o.TaskQueues
+	return o.QueueStorageLimit
 }
 
 func (o *Options) modules() []ModuleConfig {
@@ -277,6 +480,27 @@ func (o *Options) modules() []ModuleConfig {
 	return o.Modules
 }
 
+func (o *Options) indexYAMLPath() string {
+	if o == nil {
+		return ""
+	}
+	return o.IndexYAMLPath
+}
+
+func (o *Options) pythonPath() string {
+	if o == nil {
+		return ""
+	}
+	return o.PythonPath
+}
+
+func (o *Options) startupTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.StartupTimeout
+}
+
 func (o *Options) debug() LogLevel {
 	if o == nil {
 		return LogError
@@ -289,28 +513,19 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func findDevAppserver() (string, error) {
-	if p := os.Getenv("APPENGINE_DEV_APPSERVER"); p != "" {
-		if fileExists(p) {
-			return p, nil
-		}
-		return "", fmt.Errorf("invalid APPENGINE_DEV_APPSERVER environment variable; path %q doesn't exist", p)
-	}
-	return exec.LookPath(AppServerFileName)
-}
+func (c *Context) startChild() error {
+	c.clock = &Clock{onChange: c.clockChanged}
+	c.memcacheExpiry = make(map[string]time.Time)
+	c.clockTasks = make(map[string]clockTask)
+	c.moduleURLs = make(map[string]string)
 
-func findPython() (path string, err error) {
-	for _, name := range []string{"python2.7", "python"} {
-		path, err = exec.LookPath(name)
-		if err == nil {
-			return
-		}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
 	}
-	return
-}
+	c.keepTempDir = cfg.KeepTempDir
 
-func (c *Context) startChild() error {
-	python, err := findPython()
+	python, err := findPython(cfg, c.pythonPath)
 	if err != nil {
 		return fmt.Errorf("Could not find python interpreter: %v", err)
 	}
@@ -334,15 +549,16 @@ func (c *Context) startChild() error {
 		return err
 	}
 
-	c.modules = append(c.modules, ModuleConfig{Name: aeFakeName, Path: filepath.Join(c.fakeAppDir, aeFakeName+".yaml")})
+	// the fake module goes first as dev_appserver.py reads queue.yaml and
+	// index.yaml from the root of the first module
+	c.modules = append([]ModuleConfig{{Name: aeFakeName, Path: filepath.Join(c.fakeAppDir, aeFakeName+".yaml")}}, c.modules...)
 
-	if len(c.queues) > 0 {
-		var queueBuf bytes.Buffer
-		queueTempl.Execute(&queueBuf, c.queues)
-		err = ioutil.WriteFile(filepath.Join(c.fakeAppDir, "queue.yaml"), queueBuf.Bytes(), 0755)
-		if err != nil {
-			return fmt.Errorf("Error generating queue.yaml - %v", err)
-		}
+	configParams, err := c.writeAppConfig()
+	if err != nil {
+		return err
+	}
+	if err = c.loadCron(); err != nil {
+		return err
 	}
 
 	var helperBuf bytes.Buffer
@@ -351,10 +567,17 @@ func (c *Context) startChild() error {
 	if err != nil {
 		return err
 	}
-	devAppserver, err := findDevAppserver()
+	devAppserver, err := findDevAppserver(cfg)
 	if err != nil {
 		return err
 	}
+	if c.sdkVersion, err = readSDKVersion(devAppserver); err != nil {
+		return err
+	}
+	if err = checkSDKVersion(devAppserver, c.sdkVersion); err != nil {
+		return err
+	}
+	c.logf(LogDebug, "Using App Engine SDK %s at %s", c.sdkVersion, devAppserver)
 
 	appLog := c.debug
 	if c.debug == LogChild {
@@ -366,6 +589,12 @@ func (c *Context) startChild() error {
 		ComponentURL{Name: "appenginetestingadmin", Regex: regexp.MustCompile(`Starting admin server at: (\S+)`)},
 	}
 	params := []string{}
+	if c.requireIndexes {
+		params = append(params, "--require_indexes=yes")
+	}
+	if c.dsConsistency != "" {
+		params = append(params, "--datastore_consistency_policy="+c.dsConsistency)
+	}
 	for _, val := range c.modules {
 		startupComponents = append(startupComponents,
 			ComponentURL{
@@ -374,47 +603,40 @@ func (c *Context) startChild() error {
 			})
 		params = append(params, val.Path)
 	}
+	params = append(params, configParams...)
+
+	args := mergeArgs([]string{
+		fmt.Sprintf("--clear_datastore=%t", c.clearDatastore),
+		"--skip_sdk_update_check=true",
+		fmt.Sprintf("--storage_path=%s/data.datastore", c.fakeAppDir),
+		fmt.Sprintf("--log_level=%s", appLog),
+		"--dev_appserver_log_level=debug",
+		"--port=0",
+		"--api_port=0",
+		"--admin_port=0",
+	}, c.childArgs)
+	args = append(append([]string{devAppserver}, args...), params...)
 
 	switch runtime.GOOS {
 	case "windows":
-		c.child = exec.Command(
-			"cmd",
-			append([]string{"/C",
-				python,
-				devAppserver,
-				"--clear_datastore=true",
-				"--skip_sdk_update_check=true",
-				fmt.Sprintf("--storage_path=%s/data.datastore", c.fakeAppDir),
-				fmt.Sprintf("--log_level=%s", appLog),
-				"--dev_appserver_log_level=debug",
-				"--port=0",
-				"--api_port=0",
-				"--admin_port=0",
-			}, params...)...,
-		)
-	case "linux":
-		fallthrough
-	case "darwin":
-		c.child = exec.Command(
-			python,
-			append([]string{devAppserver,
-				"--clear_datastore=true",
-				"--skip_sdk_update_check=true",
-				fmt.Sprintf("--storage_path=%s/data.datastore", c.fakeAppDir),
-				fmt.Sprintf("--log_level=%s", appLog),
-				"--dev_appserver_log_level=debug",
-				"--port=0",
-				"--api_port=0",
-				"--admin_port=0",
-			}, params...)...,
-		)
+		c.child = exec.Command("cmd", append([]string{"/C", python}, args...)...)
+	case "linux", "darwin":
+		c.child = exec.Command(python, args...)
 	default:
 		err = fmt.Errorf("appenginetesting not supported on your platform of %s", runtime.GOOS)
 		return err
 	}
+	setProcessGroup(c.child)
+	if len(c.childEnv) > 0 {
+		c.child.Env = append(os.Environ(), c.childEnv...)
+	}
+	c.logf(LogDebug, "Starting %s %s", python, strings.Join(args, " "))
 
-	c.child.Stdout = os.Stdout
-	var stderr io.Reader
+	var stdout, stderr io.Reader
+	stdout, err = c.child.StdoutPipe()
+	if err != nil {
+		return err
+	}
 	stderr, err = c.child.StderrPipe()
 	if err != nil {
 		return err
@@ -423,39 +645,90 @@ func (c *Context) startChild() error {
 	if err = c.child.Start(); err != nil {
 		return err
 	}
+	c.exited = make(chan struct{})
+	c.childExit = nil
+	if err := c.writeOwner(); err != nil {
+		c.logf(LogWarning, "Could not write the owner of %s, it won't be reaped if the test is killed - %v", c.fakeAppDir, err)
+	}
 
-	// Wait until we have read the URL of all startup components
+	// Wait until we have read the URL of all startup components, or a sign
+	// that the child can't start
 	errc := make(chan error, 1)
-	componentsc := make(chan ComponentURL)
+	componentsc := make(chan ComponentURL, len(startupComponents))
+	failc := make(chan *StartupError, 1)
+	c.output = &outputTail{}
+	outputDone := make(chan struct{})
+	var started int32 // set once the child is up, to stop looking for failures
+	checkOutput := func(line []byte) {
+		c.output.add(string(line))
+		if atomic.LoadInt32(&started) != 0 {
+			return
+		}
+		if e := startupFailure(string(line)); e != nil {
+			select {
+			case failc <- e:
+			default:
+			}
+		}
+	}
 	startupComponentsCopy := make([]ComponentURL, len(startupComponents))
 	copy(startupComponentsCopy, startupComponents)
+	var readers sync.WaitGroup
+	readers.Add(2)
 	go func() {
-		s := bufio.NewScanner(stderr)
-		for s.Scan() {
-			if c.debug == LogChild {
-				c.logf(LogChild, "%s", s.Text())
-			}
+		readers.Wait()
+		c.detachLog()
+		close(outputDone)
+	}()
+	go func() {
+		defer readers.Done()
+		c.logChildOutput(stdout, checkOutput)
+	}()
+	go c.monitorChild(c.child.Process, outputDone)
+	go func() {
+		defer readers.Done()
+		errc <- c.logChildOutput(stderr, func(line []byte) {
+			checkOutput(line)
 			for _, componentURL := range startupComponentsCopy {
-				if match := componentURL.Regex.FindSubmatch(s.Bytes()); match != nil {
+				if match := componentURL.Regex.FindSubmatch(line); match != nil {
 					componentURL.URL = string(match[1])
-					componentsc <- componentURL
+					select {
+					case componentsc <- componentURL:
+					default:
+					}
 				}
 			}
-		}
-		if err := s.Err(); err != nil {
-			errc <- err
-		}
+		})
 	}()
-
+	failed := func(e *StartupError) error {
+		if p := c.child.Process; p != nil {
+			p.Kill()
+		}
+		c.Close()
+		e.Output = c.output.get()
+		return e
+	}
+
+	// Modules log that they are running before their Go code is built, so
+	// they are only started once they answer requests
+	timeout := time.After(cfg.startupTimeout(c.startupTimeout))
+	stopProbes := make(chan struct{})
+	defer close(stopProbes)
+	readyc := make(chan probeResult, len(startupComponents))
+	ready := make(map[string]error)
 	for {
 		allStarted := true
 		for _, cu := range startupComponents {
-			if cu.URL == "" {
+			if cu.URL == "" || ready[cu.Name] != nil {
 				allStarted = false
 				break
 			}
 		}
 		if allStarted {
+			atomic.StoreInt32(&started, 1)
+			c.mu.Lock()
+			c.running = true
+			c.mu.Unlock()
 			return nil
 		}
 		select {
@@ -463,31 +736,51 @@ func (c *Context) startChild() error {
 			if compURL.Name == aeFakeName {
 				c.testingURL = compURL.URL
 			}
+			c.mu.Lock()
+			c.moduleURLs[compURL.Name] = compURL.URL
+			c.mu.Unlock()
 			for x, value := range startupComponents {
 				if value.Name == compURL.Name {
 					startupComponents[x] = compURL
 					break
 				}
 			}
-		case <-time.After(15 * time.Second):
-			if p := c.child.Process; p != nil {
-				p.Kill()
+			if probe := probeURL(compURL); probe != "" {
+				ready[compURL.Name] = errNotReady
+				go func(name string) {
+					readyc <- probeResult{name, probeReady(probe, stopProbes)}
+				}(compURL.Name)
 			}
-			c.Close()
+		case r := <-readyc:
+			ready[r.name] = r.err
+		case e := <-failc:
+			// let the child write out the rest of the error
+			select {
+			case <-errc:
+			case <-time.After(startupGrace):
+			}
+			return failed(e)
+		case <-timeout:
 			for _, value := range startupComponents {
 				if value.URL == "" {
 					for _, m := range c.modules {
 						if m.Name == value.Name {
-							return fmt.Errorf("timeout starting child process supporting - %s, does %s contain module config named %s?", m.Name, m.Path, m.Name)
+							return failed(&StartupError{Reason: fmt.Sprintf("timeout starting child process supporting - %s, does %s contain module config named %s?", m.Name, m.Path, m.Name)})
 						}
 					}
-					return fmt.Errorf("timeout starting child process supporting - %s", value.Name)
+					return failed(&StartupError{Reason: fmt.Sprintf("timeout starting child process supporting - %s", value.Name)})
+				}
+				if err := ready[value.Name]; err != nil {
+					return failed(&StartupError{Reason: fmt.Sprintf("timeout waiting for module %s to answer at %s", value.Name, value.URL), Detail: err.Error()})
 				}
 			}
 			return errors.New("Timeout starting process, this error is a bug in appenginetesting")
 		case err = <-errc:
-			c.Close()
-			return fmt.Errorf("error reading child process stderr: %v", err)
+			if err != nil {
+				c.Close()
+				return fmt.Errorf("error reading child process stderr: %v", err)
+			}
+			return failed(&StartupError{Reason: "dev_appserver.py exited"})
 		}
 	}
 }
@@ -503,38 +796,70 @@ type ComponentURL struct {
 func NewContext(opts *Options) (*Context, error) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	c := &Context{
-		appid:  opts.appId(),
-		req:    req,
-		queues: opts.taskQueues(),
-		debug:  opts.debug(),
-	}
-
-	switch *overrideLogLevel {
-	case "": // do nothing, no value set
-	case "child":
-		c.debug = LogChild
-	case "debug":
-		c.debug = LogDebug
-	case "info":
-		c.debug = LogInfo
-	case "warning":
-		c.debug = LogWarning
-	case "error":
-		c.debug = LogError
-	case "critical":
-		c.debug = LogCritical
-	default:
-		log.Fatalf("[appenginetesting] loglevel given %s, not a valid option, use one of child, debug, info, warning, error, or critical.", *overrideLogLevel)
+		appid:          opts.appId(),
+		req:            req,
+		queues:         opts.queues(),
+		storageLimit:   opts.queueStorageLimit(),
+		configDir:      opts.configDir(),
+		indexYAMLPath:  opts.indexYAMLPath(),
+		requireIndexes: opts != nil && opts.RequireIndexes,
+		clearDatastore: opts.clearDatastore(),
+		pythonPath:     opts.pythonPath(),
+		startupTimeout: opts.startupTimeout(),
+		debug:          opts.debug(),
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	reapOnce.Do(func() { go Reap() })
+	if cfg.LogLevel != "" {
+		// validated when the configuration was read
+		c.debug, _ = parseLogLevel(cfg.LogLevel)
 	}
 
-	if opts != nil {
+	if opts != nil && opts.Testing != nil {
 		c.testing = opts.Testing
+		whenTestEnds(c.testing, c.testEnded)
 	}
 	c.modules = opts.modules()
 	if (opts == nil || opts.AppId == "") && len(c.modules) > 0 {
 		return nil, fmt.Errorf("Options.AppId required if using Modules")
 	}
 
+	if c.configDir != "" && !fileExists(c.configDir) {
+		return nil, fmt.Errorf("ConfigDir %s not found!", c.configDir)
+	}
+
+	seenQueues := make(map[string]bool)
+	for _, q := range c.queues {
+		if err := q.validate(); err != nil {
+			return nil, err
+		}
+		if seenQueues[q.Name] {
+			return nil, fmt.Errorf("queue %s configured more than once", q.Name)
+		}
+		seenQueues[q.Name] = true
+	}
+
+	if c.childArgs, err = opts.devAppserverArgs(); err != nil {
+		return nil, err
+	}
+	if c.childEnv, err = opts.env(); err != nil {
+		return nil, err
+	}
+
+	if opts != nil && opts.Consistency != nil {
+		if err := opts.Consistency.validate(); err != nil {
+			return nil, err
+		}
+		c.dsConsistency = opts.Consistency.childPolicy()
+		if opts.Consistency.inProcess() {
+			c.consistency = newConsistencySim(opts.Consistency)
+		}
+	}
+
 	for _, mod := range c.modules {
 		if !fileExists(mod.Path) {
 			return nil, fmt.Errorf("File %s not found for module %s!", mod.Path, mod.Name)
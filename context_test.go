@@ -1,11 +1,20 @@
 package appenginetesting
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"net/http"
+	"net/http/httptest"
 
 	"appengine"
 	"appengine/datastore"
@@ -27,19 +36,24 @@ func TestLogging(t *testing.T) {
 		t.Fatalf("NewContext: %v", err)
 	}
 	defer c.Close()
-	if c.debug == LogChild && !c.wroteToLog {
+	// the child's output is logged concurrently
+	wrote := func(debug LogLevel) bool {
+		c.logMu.Lock()
+		defer c.logMu.Unlock()
+		w := c.wroteToLog
+		c.wroteToLog = false
+		c.debug = debug
+		return w
+	}
+	if !wrote(LogChild) {
 		t.Errorf("Child should have logged!")
 	}
-	c.debug = LogChild
-	c.wroteToLog = false
 	c.Errorf("error")
-	if !c.wroteToLog {
+	if !wrote(LogInfo) {
 		t.Errorf("Error should have logged!")
 	}
-	c.wroteToLog = false
-	c.debug = LogInfo
 	c.Debugf("debug")
-	if c.wroteToLog {
+	if wrote(LogInfo) {
 		t.Errorf("Debug should not have logged!")
 	}
 	c.Errorf("error")
@@ -278,3 +292,1064 @@ func TestContext(t *testing.T) {
 		t.Fatalf("User IDs should be unique")
 	}
 }
+
+func TestClock(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	start := c.Clock().Now()
+	err = memcache.Set(c, &memcache.Item{
+		Key:        "expiring",
+		Value:      []byte("value"),
+		Expiration: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Set err = %v", err)
+	}
+	c.Clock().Advance(59 * time.Minute)
+	if _, err = memcache.Get(c, "expiring"); err != nil {
+		t.Fatalf("Get err = %v; want no error before expiration", err)
+	}
+	c.Clock().Advance(2 * time.Minute)
+	if _, err = memcache.Get(c, "expiring"); err != memcache.ErrCacheMiss {
+		t.Fatalf("Get err = %v; want ErrCacheMiss after expiration", err)
+	}
+	if elapsed := c.Clock().Now().Sub(start); elapsed < time.Hour {
+		t.Errorf("Clock advanced %v; want at least an hour", elapsed)
+	}
+
+	c.Clock().Set(start)
+	if now := c.Clock().Now(); now.Sub(start) > time.Minute {
+		t.Errorf("Clock().Now() = %v after Set(%v)", now, start)
+	}
+}
+
+func TestCron(t *testing.T) {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) // a Sunday
+	for _, test := range []struct {
+		schedule, timezone string
+		want               time.Time
+	}{
+		{"every 5 minutes", "", start.Add(5 * time.Minute)},
+		{"every 2 hours", "", start.Add(2 * time.Hour)},
+		{"every day 12:00", "", start.AddDate(0, 0, 1)},
+		{"every monday,friday 13:00", "", time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)},
+		{"every day 09:00", "America/New_York", time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseCronSchedule(test.schedule, test.timezone)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q) err = %v", test.schedule, err)
+			continue
+		}
+		if next := s.next(start); !next.Equal(test.want) {
+			t.Errorf("%q next = %v; want %v", test.schedule, next, test.want)
+		}
+	}
+	if _, err := parseCronSchedule("1st monday of september 09:00", ""); err == nil {
+		t.Errorf("parseCronSchedule of an unsupported schedule succeeded")
+	}
+
+	// custom/cron.yaml requests /test every hour
+	c, err := NewContext(&Options{
+		AppId:   "appenginetesting",
+		Testing: t,
+		Debug:   LogDebug,
+		Modules: []ModuleConfig{
+			{
+				Name: "default",
+				Path: filepath.Join("custom/custom.yaml"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	c.Clock().Advance(61 * time.Minute)
+	logs, err := c.RequestLogs(nil)
+	if err != nil {
+		t.Fatalf("RequestLogs: %v", err)
+	}
+	for _, rl := range logs {
+		if rl.URL == "/test" {
+			return
+		}
+	}
+	t.Errorf("RequestLogs = %#v; want the cron request for /test", logs)
+}
+
+func TestQueueConfig(t *testing.T) {
+	retries := 2
+	c, err := NewContext(&Options{
+		Testing: t,
+		Debug:   LogDebug,
+		Queues: []QueueConfig{
+			{
+				Name:                  "slowQueue",
+				Rate:                  "1/s",
+				BucketSize:            1,
+				MaxConcurrentRequests: 1,
+				RetryParameters:       &RetryParameters{TaskRetryLimit: &retries, MinBackoffSeconds: 1},
+			},
+			{Name: "pullQueue", Mode: "pull"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Method: "PULL", Payload: []byte("work")}, "pullQueue"); err != nil {
+		t.Fatalf("Could not add task to pull queue - %v", err)
+	}
+	stats, err := taskqueue.QueueStats(c, []string{"slowQueue", "pullQueue"}, 0)
+	if err != nil {
+		t.Fatalf("Could not get taskqueue statistics - %v", err)
+	}
+	if len(stats) != 2 || stats[1].Tasks != 1 {
+		t.Errorf("QueueStats = %#v; want one task in pullQueue", stats)
+	}
+
+	_, err = NewContext(&Options{Queues: []QueueConfig{{Name: "bad", Mode: "pull", Rate: "5/s"}}})
+	if err == nil {
+		t.Errorf("Expected an error for a pull queue with a rate")
+	}
+}
+
+func TestAppConfig(t *testing.T) {
+	c, err := NewContext(&Options{
+		AppId:   "appenginetesting",
+		Testing: t,
+		Debug:   LogDebug,
+		Queues:  []QueueConfig{{Name: "testQueue"}},
+		Modules: []ModuleConfig{
+			{
+				Name: "default",
+				Path: filepath.Join("custom/custom.yaml"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	// customQueue comes from custom/queue.yaml, testQueue from Options
+	stats, err := taskqueue.QueueStats(c, []string{"customQueue", "testQueue"}, 0)
+	if err != nil {
+		t.Fatalf("Could not get taskqueue statistics - %v", err)
+	}
+	if len(stats) != 2 {
+		t.Errorf("QueueStats = %#v; want statistics for both queues", stats)
+	}
+}
+
+func TestMergeAppConfig(t *testing.T) {
+	app := []byte("queue:\n- name: customQueue\n  rate: 1/s\n- name: otherQueue\n  rate: 2/s\n")
+	data, err := mergeQueueYAML(app, "", []QueueConfig{{Name: "customQueue", Rate: "5/s"}})
+	if err != nil {
+		t.Fatalf("mergeQueueYAML: %v", err)
+	}
+	want := "queue:\n- name: otherQueue\n  rate: 2/s\n- name: customQueue\n  rate: 5/s\n"
+	if string(data) != want {
+		t.Errorf("mergeQueueYAML = %q; want %q, with customQueue from Options", data, want)
+	}
+
+	c := &Context{modules: []ModuleConfig{{Name: "default"}}}
+	dispatch := []byte("dispatch:\n- url: \"*/api/*\"\n  module: default\n- url: \"*/admin/*\"\n  module: admin\n")
+	if missing, err := c.missingDispatchModules(dispatch); err != nil || !reflect.DeepEqual(missing, []string{"admin"}) {
+		t.Errorf("missingDispatchModules = %v, %v; want [admin]", missing, err)
+	}
+}
+
+func TestPullQueue(t *testing.T) {
+	c, err := NewContext(&Options{
+		Testing:    t,
+		Debug:      LogDebug,
+		PullQueues: []string{"pullQueue"},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	tasks := []*taskqueue.Task{
+		{Method: "PULL", Payload: []byte("a"), Tag: "a"},
+		{Method: "PULL", Payload: []byte("b"), Tag: "b"},
+	}
+	if _, err = taskqueue.AddMulti(c, tasks, "pullQueue"); err != nil {
+		t.Fatalf("Could not add tasks to pull queue - %v", err)
+	}
+	leased, err := taskqueue.LeaseByTag(c, 10, "pullQueue", 60, "a")
+	if err != nil {
+		t.Fatalf("LeaseByTag: %v", err)
+	}
+	if len(leased) != 1 {
+		t.Fatalf("Leased %d tasks by tag; want 1", len(leased))
+	}
+	c.AssertLeased(t, "pullQueue", "a", 1)
+	c.AssertLeased(t, "pullQueue", "b", 0)
+	available, err := c.AvailableTasks("pullQueue")
+	if err != nil {
+		t.Fatalf("AvailableTasks: %v", err)
+	}
+	if len(available) != 1 || available[0].Tag != "b" {
+		t.Errorf("AvailableTasks = %#v; want the task tagged b", available)
+	}
+
+	// the lease runs out on the Context's clock
+	c.Clock().Advance(2 * time.Minute)
+	c.AssertLeased(t, "pullQueue", "", 0)
+
+	if _, err = taskqueue.Lease(c, 10, "pullQueue", 3600); err != nil {
+		t.Fatalf("Lease: %v", err)
+	}
+	c.AssertLeased(t, "pullQueue", "", 2)
+	if err = c.ExpireLeases("pullQueue"); err != nil {
+		t.Fatalf("ExpireLeases: %v", err)
+	}
+	c.AssertLeased(t, "pullQueue", "", 0)
+}
+
+func TestIndexYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appenginetestingindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	indexYAML := filepath.Join(dir, "index.yaml")
+
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug, IndexYAMLPath: indexYAML})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	var entities []Entity
+	_, err = datastore.NewQuery("Entity").Filter("Foo =", "foo").Order("-Bar").GetAll(c, &entities)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	c.Close()
+
+	data, err := ioutil.ReadFile(indexYAML)
+	if err != nil {
+		t.Fatalf("index.yaml not written - %v", err)
+	}
+	indexes, err := parseIndexYAML(data)
+	if err != nil {
+		t.Fatalf("Could not parse index.yaml - %v", err)
+	}
+	if len(indexes) != 1 || indexes[0].Kind != "Entity" || !strings.Contains(indexes[0].YAML(), "direction: desc") {
+		t.Errorf("index.yaml = %s; want the index for the Entity query", data)
+	}
+}
+
+func TestRequireIndexes(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug, RequireIndexes: true})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	var entities []Entity
+	_, err = datastore.NewQuery("Entity").Filter("Foo =", "foo").Order("-Bar").GetAll(c, &entities)
+	mie, ok := err.(*MissingIndexError)
+	if !ok {
+		t.Fatalf("Query err = %v; want *MissingIndexError", err)
+	}
+	if mie.Index.Kind != "Entity" || len(mie.Index.Properties) != 2 {
+		t.Errorf("MissingIndexError.Index = %#v; want an Entity index on Foo and Bar", mie.Index)
+	}
+}
+
+func TestLogCapture(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogError})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if len(c.Logs(LogChild)) == 0 {
+		t.Errorf("Child output should have been captured")
+	}
+	c.Debugf("debug %d", 1)
+	c.Warningf("warning %d", 2)
+	var warnings []LogEntry
+	for _, e := range c.Logs(LogWarning) {
+		if e.Source == SourceContext {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Message != "warning 2" {
+		t.Errorf("Logs(LogWarning) = %#v; want the warning only", warnings)
+	}
+	c.AssertLogged(t, LogDebug, regexp.MustCompile(`^debug \d$`))
+	c.AssertNoErrors(t)
+}
+
+func TestChildLogParsing(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogError})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	// dev_appserver.py reports the startup of every module, at LogChild
+	c.AssertLogged(t, LogChild, regexp.MustCompile(`Starting module "`+aeFakeName+`"`))
+	for _, e := range c.Logs(LogDebug) {
+		if e.Source == SourceChild {
+			t.Errorf("Logs(LogDebug) has %#v; want the output of dev_appserver.py at LogChild only", e)
+		}
+	}
+
+	var p childLogParser
+	e := p.parse(`WARNING  2015-06-01 12:00:00,123 module.py:812] default: "GET /foo HTTP/1.1" 500 2`)
+	if e.Level != LogChild || e.Module != "default" || e.Time.Year() != 2015 {
+		t.Errorf("parse = %#v; want a LogChild line from module default", e)
+	}
+	e = p.parse("2015/06/01 12:00:01 WARNING: low on quota")
+	if e.Level != LogWarning || e.Module != "default" || e.Message != "low on quota" {
+		t.Errorf("parse = %#v; want an application warning from module default", e)
+	}
+	e = p.parse("Traceback (most recent call last):")
+	if e.Level != LogWarning || e.Module != "default" {
+		t.Errorf("parse = %#v; want the continuation of the warning", e)
+	}
+}
+
+func TestRequestLogs(t *testing.T) {
+	c, err := NewContext(&Options{
+		AppId:   "appenginetesting",
+		Testing: t,
+		Debug:   LogDebug,
+		Modules: []ModuleConfig{
+			{
+				Name: "default",
+				Path: filepath.Join("custom/custom.yaml"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	modHost, err := appengine.ModuleHostname(c, "default", "", "")
+	if err != nil {
+		t.Fatalf("Error fetching module hostname - %v", err)
+	}
+	resp, err := http.Get("http://" + modHost + "/test")
+	if err != nil {
+		t.Fatalf("Error fetching default/test url - %v", err)
+	}
+	resp.Body.Close()
+
+	all, err := c.RequestLogs(nil)
+	if err != nil {
+		t.Fatalf("RequestLogs: %v", err)
+	}
+	for _, rl := range all {
+		if rl.URL == probePath {
+			t.Errorf("RequestLogs has %#v; want the startup probes left out", rl)
+		}
+	}
+	logs, err := c.RequestLogs(&RequestLogFilter{MinLevel: LogInfo})
+	if err != nil {
+		t.Fatalf("RequestLogs: %v", err)
+	}
+	for _, rl := range logs {
+		if rl.URL == "/test" && rl.Status == http.StatusOK && rl.Logged(LogInfo, regexp.MustCompile(`^serving /test$`)) {
+			return
+		}
+	}
+	t.Errorf("RequestLogs = %#v; want the request for /test", logs)
+}
+
+func TestConfig(t *testing.T) {
+	defer os.Unsetenv("APPENGINETESTING_LOGLEVEL")
+	defer os.Unsetenv("APPENGINETESTING_STARTUP_TIMEOUT")
+	defer os.Unsetenv("APPENGINETESTING_CONFIG")
+
+	dir, err := ioutil.TempDir("", "appenginetestingconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ConfigFileName)
+	err = ioutil.WriteFile(path, []byte("log_level: info\nstartup_timeout: 30s\nkeep_temp_dir: true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("APPENGINETESTING_CONFIG", path)
+	os.Setenv("APPENGINETESTING_LOGLEVEL", "warning")
+
+	cfg, err := readConfig()
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	if cfg.LogLevel != "warning" || cfg.StartupTimeout != 30*time.Second || !cfg.KeepTempDir {
+		t.Errorf("readConfig = %#v; want the environment to override the config file", cfg)
+	}
+
+	// -loglevel is read by every loadConfig, whatever go test was given
+	defer func(level string) { *overrideLogLevel = level }(*overrideLogLevel)
+	*overrideLogLevel = "critical"
+	if cfg, err = loadConfig(); err != nil || cfg.LogLevel != "critical" {
+		t.Errorf("loadConfig = %#v, %v; want the -loglevel flag to apply", cfg, err)
+	}
+
+	os.Setenv("APPENGINETESTING_STARTUP_TIMEOUT", "soon")
+	if _, err = readConfig(); err == nil {
+		t.Errorf("Expected an error for an invalid startup timeout")
+	}
+	if _, err = parseLogLevel("loud"); err == nil {
+		t.Errorf("Expected an error for an invalid log level")
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if err = c.LoadFixtures("testdata/fixtures.yaml"); err != nil {
+		t.Fatalf("LoadFixtures: %v", err)
+	}
+	k := c.FixtureKey("$user_alice")
+	if k == nil || k.Parent() == nil || k.Parent().StringID() != "acme" {
+		t.Fatalf("FixtureKey = %v; want alice under acme", k)
+	}
+	var alice struct {
+		Name   string
+		Age    int
+		Tags   []string
+		Joined time.Time
+		Bio    string `datastore:",noindex"`
+	}
+	if err = datastore.Get(c, k, &alice); err != nil {
+		t.Fatalf("datastore.Get: %v", err)
+	}
+	if alice.Name != "Alice" || alice.Age != 30 || len(alice.Tags) != 2 || alice.Joined.Year() != 2015 {
+		t.Errorf("alice = %#v; want the fixture's properties", alice)
+	}
+	n, err := datastore.NewQuery("User").Count(c)
+	if err != nil || n != 1 {
+		t.Errorf("Count = %d, %v; want only alice in the default namespace", n, err)
+	}
+
+	// fixtures without a namespace go to the default one, even when the
+	// Context is in another
+	c.req.Header.Set("X-AppEngine-Current-Namespace", "other")
+	defer c.req.Header.Del("X-AppEngine-Current-Namespace")
+	if nc, err := c.namespaced(""); err != nil || nc == appengine.Context(c) {
+		t.Errorf("namespaced(\"\") in namespace other = %v, %v; want a context for the default namespace", nc, err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	type Person struct {
+		Email string `gen:"email"`
+		Age   int    `gen:"range=18,65"`
+		Role  string `gen:"oneof=admin|member"`
+		Tags  []string
+	}
+	var people []Person
+	keys, err := Generate(c, &people, 20, &GenerateOptions{Seed: 42, Store: true})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(people) != 20 || len(keys) != 20 {
+		t.Fatalf("Generated %d people with %d keys; want 20", len(people), len(keys))
+	}
+	for _, p := range people {
+		if !strings.Contains(p.Email, "@") || p.Age < 18 || p.Age > 65 || (p.Role != "admin" && p.Role != "member") {
+			t.Errorf("Generated %#v out of its tags' bounds", p)
+		}
+	}
+	n, err := datastore.NewQuery("Person").Count(c)
+	if err != nil || n != 20 {
+		t.Errorf("Count = %d, %v; want 20 stored people", n, err)
+	}
+
+	var again []Person
+	if _, err = Generate(c, &again, 20, &GenerateOptions{Seed: 42}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if again[19].Email != people[19].Email {
+		t.Errorf("Generate with the same seed gave %q, then %q", people[19].Email, again[19].Email)
+	}
+
+	if _, err = Generate(c, &again, -1, &GenerateOptions{Store: true}); err == nil {
+		t.Errorf("Generate of -1 structs should fail")
+	}
+	type Small struct {
+		Big int8 `gen:"range=0,1000"`
+	}
+	var small []Small
+	if _, err = Generate(c, &small, 1, nil); err == nil {
+		t.Errorf("Generate with a range overflowing an int8 should fail")
+	}
+	type Levels struct {
+		Level int8
+	}
+	var levels []Levels
+	if _, err = Generate(c, &levels, 50, nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	for _, l := range levels {
+		if l.Level < 0 {
+			t.Errorf("Generated a negative default int8 %d", l.Level)
+		}
+	}
+}
+
+func TestFactory(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	defer ResetFactories()
+	RegisterFactory(NewFactory(nil, "Entity", Entity{Foo: "foo"}).
+		Sequence("Bar", func(n int) interface{} { return "bar" + strconv.Itoa(n) }).
+		Parent(NewFactory(nil, "Group", struct{ Name string }{"group"})).
+		BeforePut(func(c appengine.Context, e interface{}) error {
+			e.(*Entity).Foo += "!"
+			return nil
+		}))
+	f := FactoryFor(c, "Entity")
+	if f == nil {
+		t.Fatalf("FactoryFor did not find the registered factory")
+	}
+
+	key, e, err := f.Create(map[string]interface{}{"Foo": "custom"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got := e.(*Entity); got.Foo != "custom!" || got.Bar != "bar1" {
+		t.Errorf("Create = %#v; want the override, the sequence and the hook applied", got)
+	}
+	if key.Parent() == nil || key.Parent().Kind() != "Group" {
+		t.Errorf("Create key = %v; want a Group parent", key)
+	}
+
+	keys, err := f.CreateN(3)
+	if err != nil {
+		t.Fatalf("CreateN: %v", err)
+	}
+	var last Entity
+	if err = datastore.Get(c, keys[2], &last); err != nil {
+		t.Fatalf("datastore.Get: %v", err)
+	}
+	if last.Bar != "bar4" || last.Foo != "foo!" {
+		t.Errorf("CreateN last = %#v; want the fourth entity of the sequence", last)
+	}
+	if key, _, err = f.Create(map[string]interface{}{ParentField: keys[0]}); err != nil || !key.Parent().Equal(keys[0]) {
+		t.Errorf("Create with %s = %v, %v; want a child of %v", ParentField, key, err, keys[0])
+	}
+	if _, e, err = f.Create(map[string]interface{}{"Bar": 42}); err != nil || e.(*Entity).Bar != "42" {
+		t.Errorf("Create with an int Bar = %#v, %v; want Bar formatted as 42", e, err)
+	}
+
+	if _, e, err = f.ResetSequence().Create(nil); err != nil || e.(*Entity).Bar != "bar1" {
+		t.Errorf("Create after ResetSequence = %#v, %v; want the first entity of the sequence", e, err)
+	}
+	ResetFactories()
+	if FactoryFor(c, "Entity") != nil {
+		t.Errorf("FactoryFor found a factory after ResetFactories")
+	}
+}
+
+func TestDumpDatastore(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	if err = c.LoadFixtures("testdata/fixtures.yaml"); err != nil {
+		t.Fatalf("LoadFixtures: %v", err)
+	}
+	var buf bytes.Buffer
+	if err = c.DumpDatastore(&buf); err != nil {
+		t.Fatalf("DumpDatastore: %v", err)
+	}
+	var dumped []dumpedEntity
+	if err = json.Unmarshal(buf.Bytes(), &dumped); err != nil {
+		t.Fatalf("DumpDatastore wrote invalid JSON - %v", err)
+	}
+	if len(dumped) != 3 || dumped[0].Kind != "Org" || dumped[1].Key != `Org,"acme"/User,"alice"` || dumped[2].Namespace != "other" {
+		t.Errorf("DumpDatastore = %s; want the fixtures sorted by namespace, kind and key", buf.Bytes())
+	}
+
+	_, err = datastore.Put(c, datastore.NewKey(c, "Entity", "golden", 0, nil), &Entity{Foo: "foo", Bar: "bar"})
+	if err != nil {
+		t.Fatalf("datastore.Put: %v", err)
+	}
+	c.AssertDatastoreGolden(t, "testdata/entity.golden.json", "Entity")
+}
+
+func TestDatastoreDiff(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	keep := datastore.NewKey(c, "Entity", "keep", 0, nil)
+	change := datastore.NewKey(c, "Entity", "change", 0, nil)
+	remove := datastore.NewKey(c, "Entity", "remove", 0, nil)
+	_, err = datastore.PutMulti(c, []*datastore.Key{keep, change, remove}, []Entity{{"a", "b"}, {"a", "b"}, {"a", "b"}})
+	if err != nil {
+		t.Fatalf("datastore.PutMulti: %v", err)
+	}
+
+	before := c.DatastoreState()
+	if _, err = datastore.Put(c, change, &Entity{"a", "changed"}); err != nil {
+		t.Fatalf("datastore.Put: %v", err)
+	}
+	if err = datastore.Delete(c, remove); err != nil {
+		t.Fatalf("datastore.Delete: %v", err)
+	}
+	added, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", nil), &Entity{"new", "new"})
+	if err != nil {
+		t.Fatalf("datastore.Put: %v", err)
+	}
+	c.AssertDatastoreDiff(t, before, Expect{
+		Added:    []*datastore.Key{added},
+		Modified: []*datastore.Key{change},
+		Deleted:  []*datastore.Key{remove},
+	})
+	// a nil before is an empty datastore
+	c.AssertDatastoreDiff(t, nil, Expect{Added: []*datastore.Key{keep, change, added}})
+
+	diff := propertyDiff(map[string]interface{}{"Foo": "a", "Bar": "b"}, map[string]interface{}{"Foo": "a", "Bar": "changed"})
+	if len(diff) != 1 || diff[0] != `Bar: "b" -> "changed"` {
+		t.Errorf("propertyDiff = %q; want the change of Bar", diff)
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	if _, err := NewContext(&Options{Consistency: &Consistency{Policy: "sometimes"}}); err == nil {
+		t.Errorf("NewContext with an unknown consistency policy should fail")
+	}
+
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug, Consistency: &Consistency{Policy: ConsistencyStrong}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", nil), &Entity{"a", "b"}); err != nil {
+		t.Fatalf("datastore.Put: %v", err)
+	}
+	if n, err := datastore.NewQuery("Entity").Count(c); err != nil || n != 1 {
+		t.Errorf("Count with strong consistency = %d, %v; want 1", n, err)
+	}
+	c.Close()
+
+	c, err = NewContext(&Options{Testing: t, Debug: LogDebug, Consistency: &Consistency{Policy: ConsistencyRandom, Probability: 0.001, Seed: 1}})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	keys := make([]*datastore.Key, 10)
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, "Entity", parent)
+	}
+	if keys, err = datastore.PutMulti(c, keys, make([]Entity, len(keys))); err != nil {
+		t.Fatalf("datastore.PutMulti: %v", err)
+	}
+	// the dump sees every write, without applying them
+	if entities, err := c.dumpEntities("Entity"); err != nil || len(entities) != len(keys) {
+		t.Errorf("dumpEntities = %d entities, %v; want %d", len(entities), err, len(keys))
+	}
+	if n, _ := datastore.NewQuery("Entity").KeysOnly().GetAll(c, nil); len(n) == len(keys) {
+		t.Errorf("global query saw all %d writes; want some still unapplied", len(keys))
+	}
+	if err = datastore.Get(c, keys[0], &Entity{}); err != nil {
+		t.Fatalf("datastore.Get: %v", err)
+	}
+	if n, err := datastore.NewQuery("Entity").Ancestor(parent).KeysOnly().GetAll(c, nil); err != nil || len(n) != len(keys) {
+		t.Errorf("ancestor query saw %d writes, %v; want %d", len(n), err, len(keys))
+	}
+	if n, err := datastore.NewQuery("Entity").KeysOnly().GetAll(c, nil); err != nil || len(n) != len(keys) {
+		t.Errorf("global query after the ancestor query saw %d writes, %v; want %d", len(n), err, len(keys))
+	}
+	// updates of existing entities are not hidden
+	if _, err = datastore.PutMulti(c, keys, make([]Entity, len(keys))); err != nil {
+		t.Fatalf("datastore.PutMulti: %v", err)
+	}
+	if n, err := datastore.NewQuery("Entity").KeysOnly().GetAll(c, nil); err != nil || len(n) != len(keys) {
+		t.Errorf("global query after updates saw %d entities, %v; want %d", len(n), err, len(keys))
+	}
+}
+
+func TestContendEntityGroup(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+
+	key := datastore.NewKey(c, "Entity", "contended", 0, nil)
+	child := datastore.NewKey(c, "Entity", "child", 0, key)
+	other := datastore.NewKey(c, "Entity", "other", 0, nil)
+	attempts := 0
+	put := func(k *datastore.Key) func(appengine.Context) error {
+		return func(tc appengine.Context) error {
+			attempts++
+			_, err := datastore.Put(tc, k, &Entity{"a", "b"})
+			return err
+		}
+	}
+
+	c.ContendEntityGroup(key, 2)
+	if err = datastore.RunInTransaction(c, put(child), nil); err != nil {
+		t.Errorf("RunInTransaction with 2 contended commits: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("RunInTransaction made %d attempts; want 3", attempts)
+	}
+
+	attempts = 0
+	c.ContendEntityGroup(key, 3)
+	if err = datastore.RunInTransaction(c, put(key), nil); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("RunInTransaction with 3 contended commits = %v; want ErrConcurrentTransaction", err)
+	}
+	if err = datastore.RunInTransaction(c, put(other), nil); err != nil {
+		t.Errorf("RunInTransaction on another entity group: %v", err)
+	}
+
+	c.ContendEntityGroupEvery(key, 2)
+	for i := 1; i <= 4; i++ {
+		err = datastore.RunInTransaction(c, put(key), &datastore.TransactionOptions{Attempts: 1})
+		if (i%2 == 0) != (err == datastore.ErrConcurrentTransaction) {
+			t.Errorf("commit %d = %v; want every 2nd one to fail", i, err)
+		}
+	}
+	c.ContendEntityGroupEvery(key, 0)
+	if err = datastore.RunInTransaction(c, put(key), &datastore.TransactionOptions{Attempts: 1}); err != nil {
+		t.Errorf("RunInTransaction after the contention stopped: %v", err)
+	}
+}
+
+func TestDevAppserverArgs(t *testing.T) {
+	for _, args := range [][]string{{"enable_sendmail"}, {"--clear_datastore=false"}, {"--log_level=debug"}} {
+		if _, err := NewContext(&Options{DevAppserverArgs: args}); err == nil {
+			t.Errorf("NewContext with DevAppserverArgs %q should fail", args)
+		}
+	}
+	if _, err := NewContext(&Options{Env: map[string]string{"A=B": "c"}}); err == nil {
+		t.Errorf("NewContext with an invalid Env name should fail")
+	}
+
+	merged := mergeArgs([]string{"--port=0", "--skip_sdk_update_check=true"}, []string{"--port=8080", "--enable_sendmail"})
+	if want := []string{"--skip_sdk_update_check=true", "--port=8080", "--enable_sendmail"}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeArgs = %q; want %q", merged, want)
+	}
+
+	keep := false
+	c, err := NewContext(&Options{
+		Testing:          t,
+		Debug:            LogDebug,
+		DevAppserverArgs: []string{"--enable_sendmail", "--max_module_instances=1"},
+		Env:              map[string]string{"APPENGINETESTING_EXAMPLE": "1"},
+		ClearDatastore:   &keep,
+	})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", nil), &Entity{"a", "b"}); err != nil {
+		t.Errorf("datastore.Put: %v", err)
+	}
+}
+
+func TestSDKDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appenginetesting-sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, layout := range []string{"go_appengine", filepath.Join("google-cloud-sdk", "platform", "google_appengine")} {
+		if err = os.MkdirAll(filepath.Join(dir, layout), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, layout, AppServerFileName), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sdk := range []string{"go_appengine", "google-cloud-sdk"} {
+		p := sdkDevAppserver(filepath.Join(dir, sdk))
+		if p == "" {
+			t.Errorf("sdkDevAppserver did not find dev_appserver.py in %s", sdk)
+		}
+		if found, err := findDevAppserver(&config{SDKPath: filepath.Join(dir, sdk)}); err != nil || found != p {
+			t.Errorf("findDevAppserver with SDK path %s = %s, %v; want %s", sdk, found, err, p)
+		}
+	}
+
+	devAppserver := filepath.Join(dir, "go_appengine", AppServerFileName)
+	if v, err := readSDKVersion(devAppserver); err != nil || v != "" {
+		t.Errorf("readSDKVersion without a VERSION file = %q, %v; want no version", v, err)
+	}
+	version := "release: \"1.8.9\"\ntimestamp: 1389904054\napi_versions: ['go1']\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "go_appengine", "VERSION"), []byte(version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := readSDKVersion(devAppserver)
+	if err != nil || v != "1.8.9" {
+		t.Errorf("readSDKVersion = %q, %v; want 1.8.9", v, err)
+	}
+	if err = checkSDKVersion(devAppserver, v); err == nil {
+		t.Errorf("checkSDKVersion should refuse SDK 1.8.9")
+	}
+	if compareVersions("1.9.40", "1.9.8") != 1 || compareVersions("1.9", "1.9.0") != 0 {
+		t.Errorf("compareVersions does not compare the parts of versions as numbers")
+	}
+
+	// Options.PythonPath, then the configuration, then CLOUDSDK_PYTHON
+	pythons := make(map[string]string)
+	for _, name := range []string{"opts", "config", "cloudsdk"} {
+		pythons[name] = filepath.Join(dir, name+"-python")
+		if err = ioutil.WriteFile(pythons[name], nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("CLOUDSDK_PYTHON", os.Getenv("CLOUDSDK_PYTHON"))
+	os.Setenv("CLOUDSDK_PYTHON", pythons["cloudsdk"])
+	for _, test := range []struct {
+		opts, config, want string
+	}{
+		{pythons["opts"], pythons["config"], pythons["opts"]},
+		{"", pythons["config"], pythons["config"]},
+		{"", "", pythons["cloudsdk"]},
+	} {
+		if p, err := findPython(&config{PythonPath: test.config}, test.opts); err != nil || p != test.want {
+			t.Errorf("findPython(%q, %q) = %s, %v; want %s", test.config, test.opts, p, err, test.want)
+		}
+	}
+
+	c, err := NewContext(&Options{Testing: t, Debug: LogDebug})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	if v := c.SDKVersion(); v != "" && compareVersions(v, MinSDKVersion) < 0 {
+		t.Errorf("SDKVersion = %s; want %s or newer", v, MinSDKVersion)
+	}
+}
+
+func TestStartupError(t *testing.T) {
+	for line, reason := range map[string]string{
+		"/tmp/app/broken.go:7: undefined: foo":                                            "Go compile error",
+		"yaml.scanner.ScannerError: mapping values are not allowed here":                  "yaml error",
+		"socket.error: [Errno 98] Address already in use":                                 "port already in use",
+		`INFO     2015-06-01 12:00:00,123 module.py:812] default: "GET / HTTP/1.1" 200 2`: "",
+	} {
+		e := startupFailure(line)
+		if (e == nil && reason != "") || (e != nil && e.Reason != reason) {
+			t.Errorf("startupFailure(%q) = %v; want %q", line, e, reason)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "appenginetesting-broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	yaml := "application: testapp\nmodule: broken\nversion: 1\nruntime: go\napi_version: go1\nhandlers:\n- url: /.*\n  script: _go_app\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "broken.yaml"), []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := "package broken\n\nfunc init() {\n\tundefinedFunction()\n}\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "broken.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	c, err := NewContext(&Options{
+		AppId:   "testapp",
+		Testing: t,
+		Modules: []ModuleConfig{{Name: "broken", Path: filepath.Join(dir, "broken.yaml")}},
+	})
+	if err == nil {
+		c.Close()
+		t.Fatalf("NewContext with a module that doesn't compile should fail")
+	}
+	se, ok := err.(*StartupError)
+	if !ok {
+		t.Fatalf("NewContext error = %T %v; want a *StartupError", err, err)
+	}
+	if se.Reason != "Go compile error" || filepath.Base(se.File) != "broken.go" || se.Line != 4 || len(se.Output) == 0 {
+		t.Errorf("StartupError = %+v; want the compile error at broken.go:4 and the output", se)
+	}
+	if d := time.Since(start); d >= defaultStartupTimeout {
+		t.Errorf("NewContext took %s to fail; want it to fail before the startup timeout", d)
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	if d := (&config{}).startupTimeout(0); d != defaultStartupTimeout {
+		t.Errorf("startupTimeout without settings = %s; want %s", d, defaultStartupTimeout)
+	}
+	if d := (&config{}).startupTimeout(time.Minute); d != time.Minute {
+		t.Errorf("startupTimeout with Options.StartupTimeout = %s; want 1m", d)
+	}
+	if d := (&config{StartupTimeout: 30 * time.Second}).startupTimeout(time.Minute); d != 30*time.Second {
+		t.Errorf("startupTimeout with both settings = %s; want the configured 30s", d)
+	}
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests < 3 {
+			http.Error(w, "building", http.StatusServiceUnavailable)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	if err := probeReady(ts.URL+"/", make(chan struct{})); err != nil || requests != 3 {
+		t.Errorf("probeReady = %v after %d requests; want success on the 3rd", err, requests)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if err := probeReady("http://127.0.0.1:1/", stop); err == nil {
+		t.Errorf("probeReady of a closed port should fail once stopped")
+	}
+
+	c, err := NewContext(&Options{Testing: t, StartupTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	if _, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", nil), &Entity{"a", "b"}); err != nil {
+		t.Errorf("datastore.Put: %v", err)
+	}
+}
+
+func TestChildCrash(t *testing.T) {
+	// no Testing, as the crash would fail this test
+	c, err := NewContext(nil)
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	if err = c.child.Process.Kill(); err != nil {
+		t.Fatalf("killing the child: %v", err)
+	}
+	<-c.exited
+
+	_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Entity", nil), &Entity{"a", "b"})
+	exitErr, ok := err.(*ErrChildExited)
+	if !ok {
+		t.Fatalf("datastore.Put after a crash = %T %v; want an *ErrChildExited", err, err)
+	}
+	if !strings.Contains(exitErr.Status, "killed") {
+		t.Errorf("ErrChildExited.Status = %q; want the signal that killed the child", exitErr.Status)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	pid := c.child.Process.Pid
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- c.Close() }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+	if groupAlive(pid) {
+		t.Errorf("processes of the child's group still running after Close")
+	}
+	if err = c.Close(); err != nil {
+		t.Errorf("Close of a closed Context: %v", err)
+	}
+	if err = (*Context)(nil).Close(); err != nil {
+		t.Errorf("Close of a nil Context: %v", err)
+	}
+}
+
+func TestReap(t *testing.T) {
+	c, err := NewContext(&Options{Testing: t})
+	if err != nil {
+		t.Fatalf("NewContext: %v", err)
+	}
+	defer c.Close()
+	var o owner
+	data, err := ioutil.ReadFile(filepath.Join(c.fakeAppDir, ownerFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &o)
+	}
+	if err != nil || o.PID != os.Getpid() || o.ChildPID != c.child.Process.Pid || len(o.ChildArgs) == 0 {
+		t.Errorf("owner = %+v, %v; want this process and the child", o, err)
+	}
+	if cmdline, err := processCommand(o.ChildPID); err == nil && !sameCommand(o.ChildArgs, cmdline) {
+		t.Errorf("sameCommand(%q, %q) = false; want the child recognized", o.ChildArgs, cmdline)
+	}
+
+	// a directory left by a test binary that is gone, with a pid unlikely to be in use
+	dir, err := ioutil.TempDir("", aeFakeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ = json.Marshal(owner{PID: 1 << 22, ChildPID: 1<<22 + 1, Started: time.Now()})
+	if err = ioutil.WriteFile(filepath.Join(dir, ownerFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// one whose child pid was reused, by this process, which must survive
+	reused, err := ioutil.TempDir("", aeFakeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reused)
+	data, _ = json.Marshal(owner{
+		PID:       1 << 22,
+		ChildPID:  os.Getpid(),
+		ChildArgs: []string{"python", AppServerFileName, "--storage_path=" + reused + "/data.datastore"},
+		Started:   time.Now(),
+	})
+	if err = ioutil.WriteFile(filepath.Join(reused, ownerFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reaped, err := Reap()
+	if err != nil {
+		t.Fatalf("Reap: %v", err)
+	}
+	found := 0
+	for _, d := range reaped {
+		if d == c.fakeAppDir {
+			t.Errorf("Reap cleaned up the directory of a running Context")
+		}
+		if d == dir || d == reused {
+			found++
+		}
+	}
+	if _, err = processCommand(os.Getpid()); err != nil {
+		// without command lines, as on Windows, the reused pid is left alone
+		found++
+		os.RemoveAll(reused)
+	}
+	if found != 2 || fileExists(dir) || fileExists(reused) {
+		t.Errorf("Reap = %q; want %s and %s cleaned up", reaped, dir, reused)
+	}
+}
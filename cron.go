@@ -0,0 +1,202 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// cronJob is a job of the application's cron.yaml.  dev_appserver.py doesn't
+// run cron jobs, so the Context requests them when the Clock reaches their
+// due time.
+type cronJob struct {
+	URL      string `yaml:"url"`
+	Schedule string `yaml:"schedule"`
+	Target   string `yaml:"target"`
+	Timezone string `yaml:"timezone"`
+
+	schedule *cronSchedule
+	next     time.Time // on the Clock's timeline
+}
+
+// cronSchedule is a parsed cron.yaml schedule.  Only the simple forms are
+// supported: "every N minutes", "every N hours", "every day HH:MM" and
+// "every monday,friday HH:MM".
+type cronSchedule struct {
+	interval     time.Duration  // for "every N minutes|hours"
+	days         [7]bool        // by time.Weekday, for the daily and weekly forms
+	hour, minute int            // time of day of the daily and weekly forms
+	loc          *time.Location // time zone of hour and minute
+}
+
+var (
+	cronIntervalRegex = regexp.MustCompile(`^every (\d+) (minutes|mins|hours)$`)
+	cronDailyRegex    = regexp.MustCompile(`^every ([a-z,]+) (\d\d):(\d\d)$`)
+)
+
+var cronWeekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseCronSchedule parses a cron.yaml schedule in the time zone tz, which
+// defaults to UTC.
+func parseCronSchedule(schedule, tz string) (*cronSchedule, error) {
+	s := &cronSchedule{loc: time.UTC}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q - %v", tz, err)
+		}
+		s.loc = loc
+	}
+	schedule = strings.ToLower(strings.Join(strings.Fields(schedule), " "))
+	if m := cronIntervalRegex.FindStringSubmatch(schedule); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if n == 0 {
+			return nil, fmt.Errorf("schedule %q has no interval", schedule)
+		}
+		s.interval = time.Duration(n) * time.Minute
+		if m[2] == "hours" {
+			s.interval = time.Duration(n) * time.Hour
+		}
+		return s, nil
+	}
+	m := cronDailyRegex.FindStringSubmatch(schedule)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported schedule %q", schedule)
+	}
+	for _, day := range strings.Split(m[1], ",") {
+		if day == "day" {
+			s.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		wd, ok := cronWeekdays[day]
+		if !ok {
+			return nil, fmt.Errorf("unsupported schedule %q", schedule)
+		}
+		s.days[wd] = true
+	}
+	s.hour, _ = strconv.Atoi(m[2])
+	s.minute, _ = strconv.Atoi(m[3])
+	if s.hour > 23 || s.minute > 59 {
+		return nil, fmt.Errorf("schedule %q has an invalid time of day", schedule)
+	}
+	return s, nil
+}
+
+// next returns the first due time of the schedule after t.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.interval > 0 {
+		return t.Add(s.interval)
+	}
+	local := t.In(s.loc)
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		due := time.Date(day.Year(), day.Month(), day.Day(), s.hour, s.minute, 0, 0, s.loc)
+		if s.days[due.Weekday()] && due.After(t) {
+			return due
+		}
+	}
+	panic("appenginetesting: cron schedule without days")
+}
+
+// loadCron reads the cron jobs from the cron.yaml written into fakeAppDir
+// and schedules them from the Clock's current time.  Jobs with a schedule
+// that isn't supported are skipped with a warning.
+func (c *Context) loadCron() error {
+	data, err := ioutil.ReadFile(filepath.Join(c.fakeAppDir, "cron.yaml"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var file struct {
+		Cron []*cronJob `yaml:"cron"`
+	}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse the application's cron.yaml - %v", err)
+	}
+	now := c.clock.Now()
+	var jobs []*cronJob
+	for _, job := range file.Cron {
+		if job.schedule, err = parseCronSchedule(job.Schedule, job.Timezone); err != nil {
+			c.logf(LogWarning, "Cron job %s won't run - %v", job.URL, err)
+			continue
+		}
+		job.next = job.schedule.next(now)
+		jobs = append(jobs, job)
+	}
+	c.mu.Lock()
+	c.cronJobs = jobs
+	c.mu.Unlock()
+	return nil
+}
+
+// runDueCron requests the cron jobs that are due on the Clock's timeline.  A
+// job runs once however many of its due times the Clock skipped, and is then
+// scheduled from the Clock's current time.
+func (c *Context) runDueCron() {
+	now := c.clock.Now()
+	var due []*cronJob
+	c.mu.Lock()
+	for _, job := range c.cronJobs {
+		if now.Before(job.next) {
+			continue
+		}
+		job.next = job.schedule.next(now)
+		due = append(due, job)
+	}
+	c.mu.Unlock()
+	for _, job := range due {
+		if err := c.runCronJob(job); err != nil {
+			c.logf(LogWarning, "Could not run cron job %s - %v", job.URL, err)
+		}
+	}
+}
+
+// runCronJob requests the job's URL from its target module, or the first
+// module of the application, the way App Engine's cron service does.
+func (c *Context) runCronJob(job *cronJob) error {
+	target := job.Target
+	if target == "" {
+		if len(c.modules) < 2 {
+			return fmt.Errorf("the application has no modules")
+		}
+		target = c.modules[1].Name
+	}
+	c.mu.Lock()
+	base, ok := c.moduleURLs[target]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("module %s is not started", target)
+	}
+	req, err := http.NewRequest("GET", base+job.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-AppEngine-Cron", "true")
+	req.Header.Set("X-AppEngine-Fake-Is-Admin", "1")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", target, res.Status)
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"net/http"
+
+	"appengine"
 )
 
 func init() {
@@ -11,5 +13,6 @@ func init() {
 }
 
 func test(w http.ResponseWriter, r *http.Request) {
+	appengine.NewContext(r).Infof("serving %s", r.URL.Path)
 	fmt.Fprintf(w, "Hey, it works!")
 }
@@ -0,0 +1,162 @@
+package appenginetesting
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+)
+
+// DatastoreState is a snapshot of every entity in the datastore, taken by
+// Context.DatastoreState.
+type DatastoreState struct {
+	entities map[string]dumpedEntity // by entityID
+	err      error
+}
+
+// Expect lists the entities a test expects to have changed between two
+// DatastoreStates.  Entities missing from all three lists must be unchanged.
+type Expect struct {
+	Added    []*datastore.Key
+	Modified []*datastore.Key
+	Deleted  []*datastore.Key
+}
+
+func entityID(namespace, path string) string {
+	if namespace == "" {
+		return path
+	}
+	return namespace + ":" + path
+}
+
+func keyID(k *datastore.Key) string {
+	return entityID(k.Namespace(), keyPath(k))
+}
+
+// DatastoreState takes a snapshot of every entity in every namespace, to be
+// compared with the datastore later with AssertDatastoreDiff.  An error taking
+// the snapshot is reported by AssertDatastoreDiff.
+//
+// DatastoreState is not part of the appengine.Context interface.
+func (c *Context) DatastoreState() *DatastoreState {
+	entities, err := c.dumpEntities()
+	if err != nil {
+		return &DatastoreState{err: err}
+	}
+	s := &DatastoreState{entities: make(map[string]dumpedEntity, len(entities))}
+	for _, e := range entities {
+		s.entities[entityID(e.Namespace, e.Key)] = e
+	}
+	return s
+}
+
+// AssertDatastoreDiff fails t unless exactly the entities in want were added,
+// modified and deleted since before was taken.  Every unexpected change is
+// reported with the properties that changed.  A nil before stands for an
+// empty datastore.
+//
+// AssertDatastoreDiff is not part of the appengine.Context interface.
+func (c *Context) AssertDatastoreDiff(t *testing.T, before *DatastoreState, want Expect) {
+	t.Helper()
+	if before == nil {
+		before = &DatastoreState{}
+	}
+	after := c.DatastoreState()
+	for _, s := range []*DatastoreState{before, after} {
+		if s.err != nil {
+			t.Errorf("Could not read the datastore state - %v", s.err)
+			return
+		}
+	}
+	expected := make(map[string]string)
+	for change, keys := range map[string][]*datastore.Key{"added": want.Added, "modified": want.Modified, "deleted": want.Deleted} {
+		for _, k := range keys {
+			expected[keyID(k)] = change
+		}
+	}
+
+	var problems []string
+	ids := make(map[string]bool)
+	for id := range before.entities {
+		ids[id] = true
+	}
+	for id := range after.entities {
+		ids[id] = true
+	}
+	for id := range ids {
+		old, existed := before.entities[id]
+		cur, exists := after.entities[id]
+		change := ""
+		var details []string
+		switch {
+		case !existed:
+			change = "added"
+		case !exists:
+			change = "deleted"
+		default:
+			details = propertyDiff(old.Properties, cur.Properties)
+			if len(details) > 0 {
+				change = "modified"
+			}
+		}
+		if change != expected[id] {
+			if change == "" {
+				change = "unchanged"
+			}
+			msg := fmt.Sprintf("%s was %s", id, change)
+			if exp := expected[id]; exp != "" {
+				msg += fmt.Sprintf(", expected it to be %s", exp)
+			}
+			for _, d := range details {
+				msg += "\n\t" + d
+			}
+			problems = append(problems, msg)
+		}
+		delete(expected, id)
+	}
+	for id, change := range expected {
+		problems = append(problems, fmt.Sprintf("%s was not found, expected it to be %s", id, change))
+	}
+	sort.Strings(problems)
+	for _, p := range problems {
+		t.Errorf("Unexpected datastore change: %s", p)
+	}
+}
+
+// propertyDiff describes the properties that differ between old and cur.
+func propertyDiff(old, cur map[string]interface{}) []string {
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range cur {
+		names[name] = true
+	}
+	var diff []string
+	for name := range names {
+		o, hadOld := old[name]
+		n, hasNew := cur[name]
+		switch {
+		case !hadOld:
+			diff = append(diff, fmt.Sprintf("%s: added %s", name, jsonString(n)))
+		case !hasNew:
+			diff = append(diff, fmt.Sprintf("%s: removed %s", name, jsonString(o)))
+		case !reflect.DeepEqual(o, n):
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", name, jsonString(o), jsonString(n)))
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func jsonString(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(data))
+}
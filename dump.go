@@ -0,0 +1,213 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// dumpedEntity is an entity as written by DumpDatastore.
+type dumpedEntity struct {
+	Namespace  string                 `json:"namespace"`
+	Kind       string                 `json:"kind"`
+	Key        string                 `json:"key"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// keyPath formats the key with its ancestors, like Org,"acme"/User,42.
+func keyPath(k *datastore.Key) string {
+	var parts []string
+	for ; k != nil; k = k.Parent() {
+		if k.StringID() != "" {
+			parts = append(parts, fmt.Sprintf("%s,%q", k.Kind(), k.StringID()))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s,%d", k.Kind(), k.IntID()))
+		}
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/")
+}
+
+// dumpValue converts a property value to its JSON form.  Values without a
+// JSON equivalent are objects naming their type, as in fixture files.
+func dumpValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return map[string]interface{}{"type": "time", "value": v.UTC().Format(time.RFC3339Nano)}
+	case *datastore.Key:
+		return map[string]interface{}{"type": "key", "value": keyPath(v)}
+	case []byte:
+		return map[string]interface{}{"type": "blob", "value": base64.StdEncoding.EncodeToString(v)}
+	case appengine.GeoPoint:
+		return map[string]interface{}{"type": "geopoint", "lat": v.Lat, "lng": v.Lng}
+	case appengine.BlobKey:
+		return map[string]interface{}{"type": "blobkey", "value": string(v)}
+	}
+	return v
+}
+
+// namespaces returns the namespaces of the datastore, the default one first.
+func (c *Context) namespaces() ([]string, error) {
+	keys, err := datastore.NewQuery("__namespace__").KeysOnly().GetAll(internalContext{c}, nil)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, 0, len(keys))
+	for _, k := range keys {
+		namespaces = append(namespaces, k.StringID())
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// kinds returns the kinds stored in the namespace, leaving out the datastore's
+// own.
+func kinds(c appengine.Context) ([]string, error) {
+	keys, err := datastore.NewQuery("__kind__").KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k.StringID(), "__") {
+			kinds = append(kinds, k.StringID())
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
+// dumpEntities reads the entities of the given kinds, or of every kind, in
+// every namespace, sorted by namespace, kind and key.  Its queries bypass
+// the simulations of the Context, so that the dump shows every entity.
+func (c *Context) dumpEntities(only ...string) ([]dumpedEntity, error) {
+	wanted := make(map[string]bool)
+	for _, k := range only {
+		wanted[k] = true
+	}
+	namespaces, err := c.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	var entities []dumpedEntity
+	for _, ns := range namespaces {
+		nc, err := appengine.Namespace(internalContext{c}, ns)
+		if err != nil {
+			return nil, err
+		}
+		ks, err := kinds(nc)
+		if err != nil {
+			return nil, err
+		}
+		for _, kind := range ks {
+			if len(wanted) > 0 && !wanted[kind] {
+				continue
+			}
+			var kindEntities []dumpedEntity
+			for it := datastore.NewQuery(kind).Run(nc); ; {
+				var props datastore.PropertyList
+				k, err := it.Next(&props)
+				if err == datastore.Done {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				e := dumpedEntity{Namespace: ns, Kind: kind, Key: keyPath(k), Properties: make(map[string]interface{})}
+				for _, p := range props {
+					v := dumpValue(p.Value)
+					if p.Multiple {
+						list, _ := e.Properties[p.Name].([]interface{})
+						e.Properties[p.Name] = append(list, v)
+					} else {
+						e.Properties[p.Name] = v
+					}
+				}
+				kindEntities = append(kindEntities, e)
+			}
+			sort.Sort(byKeyPath(kindEntities))
+			entities = append(entities, kindEntities...)
+		}
+	}
+	return entities, nil
+}
+
+type byKeyPath []dumpedEntity
+
+func (s byKeyPath) Len() int           { return len(s) }
+func (s byKeyPath) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s byKeyPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// DumpDatastore writes every entity of the given kinds, or of every kind if
+// none are given, in every namespace to w as indented JSON.  Entities are
+// sorted by namespace, kind and key, and properties by name, so the output is
+// stable enough to compare with a golden file, see AssertDatastoreGolden.
+//
+// DumpDatastore is not part of the appengine.Context interface.
+func (c *Context) DumpDatastore(w io.Writer, kinds ...string) error {
+	entities, err := c.dumpEntities(kinds...)
+	if err != nil {
+		return err
+	}
+	if entities == nil {
+		entities = []dumpedEntity{}
+	}
+	data, err := json.MarshalIndent(entities, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// updateGolden reports whether golden files should be rewritten, either with
+// the -update flag of the test binary, if it defines one, or through the
+// configuration.
+func updateGolden() bool {
+	if f := flag.Lookup("update"); f != nil && f.Value.String() == "true" {
+		return true
+	}
+	cfg, err := loadConfig()
+	return err == nil && cfg.UpdateGolden
+}
+
+// AssertDatastoreGolden fails t unless the DumpDatastore output for the kinds
+// matches the golden file at path.  When golden files are being updated, the
+// file is written instead.
+//
+// AssertDatastoreGolden is not part of the appengine.Context interface.
+func (c *Context) AssertDatastoreGolden(t *testing.T, path string, kinds ...string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := c.DumpDatastore(&buf, kinds...); err != nil {
+		t.Errorf("Could not dump the datastore - %v", err)
+		return
+	}
+	if updateGolden() {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Errorf("Could not update golden file %s - %v", path, err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("Could not read golden file %s - %v; run with -update or APPENGINETESTING_UPDATE=true to create it", path, err)
+		return
+	}
+	if !bytes.Equal(want, buf.Bytes()) {
+		t.Errorf("Datastore does not match golden file %s; got:\n%s", path, buf.Bytes())
+	}
+}
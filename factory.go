@@ -0,0 +1,252 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// ParentField is the key of a Factory override giving the parent key of the
+// created entity.
+const ParentField = "$parent"
+
+var (
+	factoriesMu sync.Mutex
+	factories   = make(map[string]*Factory)
+)
+
+// Factory creates entities of a kind from a template struct.  Factories can
+// be set up once, without a Context, and bound to the Context of each test
+// with For:
+//
+//	func TestMain(m *testing.M) {
+//		appenginetesting.RegisterFactory(appenginetesting.NewFactory(nil, "User", User{Role: "member"}).
+//			Sequence("Email", func(n int) interface{} { return fmt.Sprintf("user%d@example.com", n) }))
+//		os.Exit(m.Run())
+//	}
+//
+//	func TestUsers(t *testing.T) {
+//		...
+//		users := appenginetesting.FactoryFor(c, "User")
+//		key, _, err := users.Create(map[string]interface{}{"Role": "admin"})
+//		keys, err := users.CreateN(10)
+//	}
+type Factory struct {
+	c        appengine.Context
+	kind     string
+	template reflect.Value
+	shared   *factoryShared
+}
+
+// factoryShared is the part of a Factory shared with the copies made by For.
+type factoryShared struct {
+	mu        sync.Mutex
+	n         int // entities created so far, for sequences
+	sequences map[string]func(n int) interface{}
+	parent    *Factory
+	hooks     []func(c appengine.Context, entity interface{}) error
+}
+
+// NewFactory returns a Factory creating entities of the kind as copies of
+// template, a struct or a pointer to a struct.  c may be nil for a Factory
+// that is bound to a Context later with For.  Like regexp.MustCompile, it
+// panics if template is of another type, so that factories can be set up in
+// a chain of calls.
+func NewFactory(c appengine.Context, kind string, template interface{}) *Factory {
+	v := reflect.ValueOf(template)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("appenginetesting: NewFactory(%q) needs a struct or a pointer to a struct as template, got %T", kind, template))
+	}
+	return &Factory{
+		c:        c,
+		kind:     kind,
+		template: v,
+		shared:   &factoryShared{sequences: make(map[string]func(int) interface{})},
+	}
+}
+
+// RegisterFactory makes f available to FactoryFor under its kind.
+func RegisterFactory(f *Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[f.kind] = f
+}
+
+// ResetFactories removes every Factory registered with RegisterFactory.  Tests
+// that register their own factories can defer it to leave no trace.
+func ResetFactories() {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories = make(map[string]*Factory)
+}
+
+// FactoryFor returns the Factory registered for the kind bound to c, or nil
+// if there is none.
+func FactoryFor(c appengine.Context, kind string) *Factory {
+	factoriesMu.Lock()
+	f := factories[kind]
+	factoriesMu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f.For(c)
+}
+
+// For returns a copy of f that creates its entities through c.  Sequences,
+// associations and hooks are shared with f.
+func (f *Factory) For(c appengine.Context) *Factory {
+	bound := *f
+	bound.c = c
+	return &bound
+}
+
+// Sequence sets the field of every created entity to fn(n), where n is 1 for
+// the first entity created by the Factory, 2 for the second, etc.
+func (f *Factory) Sequence(field string, fn func(n int) interface{}) *Factory {
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	f.shared.sequences[field] = fn
+	return f
+}
+
+// ResetSequence starts the sequences of f, and of the copies made by For, over
+// at 1.  A Factory shared by several tests can be reset by each of them to
+// create the same entities whatever the order the tests run in.
+func (f *Factory) ResetSequence() *Factory {
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	f.shared.n = 0
+	return f
+}
+
+// Parent makes every created entity the child of a new entity created by
+// parent, unless a parent key is given with the ParentField override.
+func (f *Factory) Parent(parent *Factory) *Factory {
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	f.shared.parent = parent
+	return f
+}
+
+// BeforePut adds a hook that is called with a pointer to every entity before
+// it is put.  An error from a hook fails the creation.
+func (f *Factory) BeforePut(hook func(c appengine.Context, entity interface{}) error) *Factory {
+	f.shared.mu.Lock()
+	defer f.shared.mu.Unlock()
+	f.shared.hooks = append(f.shared.hooks, hook)
+	return f
+}
+
+// Create puts a new entity built from the template, the sequences and the
+// overrides, a map of field names to values, and returns its key and a
+// pointer to it.
+func (f *Factory) Create(overrides map[string]interface{}) (*datastore.Key, interface{}, error) {
+	if f.c == nil {
+		return nil, nil, fmt.Errorf("Factory for %s is not bound to a Context, use For", f.kind)
+	}
+	f.shared.mu.Lock()
+	f.shared.n++
+	n := f.shared.n
+	sequences := make(map[string]func(int) interface{}, len(f.shared.sequences))
+	for field, fn := range f.shared.sequences {
+		sequences[field] = fn
+	}
+	parentFactory := f.shared.parent
+	hooks := f.shared.hooks
+	f.shared.mu.Unlock()
+
+	entity := reflect.New(f.template.Type())
+	entity.Elem().Set(f.template)
+	for field, fn := range sequences {
+		if err := setField(entity.Elem(), field, fn(n)); err != nil {
+			return nil, nil, err
+		}
+	}
+	var parent *datastore.Key
+	for field, value := range overrides {
+		if field == ParentField {
+			k, ok := value.(*datastore.Key)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s override needs a *datastore.Key, got %T", ParentField, value)
+			}
+			parent = k
+			continue
+		}
+		if err := setField(entity.Elem(), field, value); err != nil {
+			return nil, nil, err
+		}
+	}
+	if parent == nil && parentFactory != nil {
+		var err error
+		if parent, _, err = parentFactory.For(f.c).Create(nil); err != nil {
+			return nil, nil, fmt.Errorf("creating the parent of %s - %v", f.kind, err)
+		}
+	}
+	for _, hook := range hooks {
+		if err := hook(f.c, entity.Interface()); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, err := datastore.Put(f.c, datastore.NewIncompleteKey(f.c, f.kind, parent), entity.Interface())
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, entity.Interface(), nil
+}
+
+// CreateN creates n entities without overrides and returns their keys.
+func (f *Factory) CreateN(n int) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, 0, n)
+	for i := 0; i < n; i++ {
+		key, _, err := f.Create(nil)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// setField sets the exported field of the struct v to value, converting it to
+// the field's type if needed.  Numbers are formatted in decimal when the field
+// is a string, rather than converted to the character they encode.
+func setField(v reflect.Value, field string, value interface{}) error {
+	fv := v.FieldByName(field)
+	if !fv.IsValid() || !fv.CanSet() {
+		return fmt.Errorf("%s has no exported field %s", v.Type(), field)
+	}
+	if value == nil {
+		fv.Set(reflect.Zero(fv.Type()))
+		return nil
+	}
+	val := reflect.ValueOf(value)
+	isString := fv.Kind() == reflect.String
+	switch {
+	case isString && isInt(val.Kind()):
+		fv.SetString(strconv.FormatInt(val.Int(), 10))
+	case isString && isUint(val.Kind()):
+		fv.SetString(strconv.FormatUint(val.Uint(), 10))
+	case val.Type().AssignableTo(fv.Type()):
+		fv.Set(val)
+	case val.Type().ConvertibleTo(fv.Type()):
+		fv.Set(val.Convert(fv.Type()))
+	default:
+		return fmt.Errorf("cannot set %s.%s of type %s to %T", v.Type(), field, fv.Type(), value)
+	}
+	return nil
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
@@ -0,0 +1,315 @@
+package appenginetesting
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// maxPutMulti is the number of entities written by one datastore.PutMulti.
+const maxPutMulti = 500
+
+// fixture is one entity of a fixture file, see LoadFixtures.
+type fixture struct {
+	Ref        string                 `yaml:"ref"`
+	Kind       string                 `yaml:"kind"`
+	KeyName    string                 `yaml:"key_name"`
+	ID         int64                  `yaml:"id"`
+	Parent     string                 `yaml:"parent"`
+	Namespace  string                 `yaml:"namespace"`
+	Properties map[string]interface{} `yaml:"properties"`
+
+	key *datastore.Key
+}
+
+// LoadFixtures reads the entities defined in the given YAML or JSON files and
+// writes them to the datastore.  A fixture file is a list of entities:
+//
+//	# users.yaml
+//	- ref: user_alice          # name to refer to the entity as $user_alice
+//	  kind: User
+//	  key_name: alice          # or id: 42; neither gives an incomplete key
+//	  parent: $org_acme
+//	  namespace: customers
+//	  properties:
+//	    Name: Alice
+//	    Age: 30
+//	    Tags: [admin, beta]    # a multi-valued property
+//	    Org: $org_acme         # a *datastore.Key
+//	    Joined: {type: time, value: "2015-01-02T15:04:05Z"}
+//	    Home: {type: geopoint, lat: 52.37, lng: 4.89}
+//	    Avatar: {type: blob, value: aGVsbG8=}   # base64
+//	    Bio: {type: text, value: "..."}
+//	    Email: {value: alice@example.com, noindex: true}
+//
+// Strings starting with $ are references to other fixtures, resolved across
+// all the files; use $$ for a literal leading $.  Referenced fixtures need a
+// key_name or id.  The keys of named fixtures are available through
+// FixtureKey afterwards.
+//
+// LoadFixtures is not part of the appengine.Context interface.
+func (c *Context) LoadFixtures(paths ...string) error {
+	var fixtures []*fixture
+	refs := make(map[string]*fixture)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var fs []*fixture
+		if err = yaml.Unmarshal(data, &fs); err != nil {
+			return fmt.Errorf("could not parse fixtures in %s - %v", path, err)
+		}
+		for _, f := range fs {
+			if f.Kind == "" {
+				return fmt.Errorf("fixture in %s without a kind", path)
+			}
+			if f.Ref != "" {
+				if refs[f.Ref] != nil {
+					return fmt.Errorf("fixture $%s defined more than once", f.Ref)
+				}
+				refs[f.Ref] = f
+			}
+			fixtures = append(fixtures, f)
+		}
+	}
+
+	for _, f := range fixtures {
+		if _, err := c.fixtureKey(f, refs, nil); err != nil {
+			return err
+		}
+	}
+
+	byNamespace := make(map[string][]*fixture)
+	var namespaces []string
+	for _, f := range fixtures {
+		if _, ok := byNamespace[f.Namespace]; !ok {
+			namespaces = append(namespaces, f.Namespace)
+		}
+		byNamespace[f.Namespace] = append(byNamespace[f.Namespace], f)
+	}
+	for _, ns := range namespaces {
+		fs := byNamespace[ns]
+		keys := make([]*datastore.Key, len(fs))
+		entities := make([]datastore.PropertyList, len(fs))
+		for i, f := range fs {
+			keys[i] = f.key
+			props, err := fixtureProperties(f, refs)
+			if err != nil {
+				return err
+			}
+			entities[i] = props
+		}
+		nc, err := c.namespaced(ns)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(keys); start += maxPutMulti {
+			end := start + maxPutMulti
+			if end > len(keys) {
+				end = len(keys)
+			}
+			put, err := datastore.PutMulti(nc, keys[start:end], entities[start:end])
+			if err != nil {
+				return err
+			}
+			// incomplete keys are now allocated
+			for i, k := range put {
+				fs[start+i].key = k
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fixtureKeys == nil {
+		c.fixtureKeys = make(map[string]*datastore.Key)
+	}
+	for ref, f := range refs {
+		c.fixtureKeys[ref] = f.key
+	}
+	return nil
+}
+
+// FixtureKey returns the key of the fixture loaded with the given ref, without
+// the leading $, or nil if there is none.
+//
+// FixtureKey is not part of the appengine.Context interface.
+func (c *Context) FixtureKey(ref string) *datastore.Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fixtureKeys[strings.TrimPrefix(ref, "$")]
+}
+
+// namespaced returns a context for the namespace, or c itself for the
+// Context's current namespace.
+func (c *Context) namespaced(namespace string) (appengine.Context, error) {
+	if namespace == c.GetCurrentNamespace() {
+		return c, nil
+	}
+	return appengine.Namespace(c, namespace)
+}
+
+// fixtureKey builds the key of f, and those of its ancestors first.  visiting
+// detects parent cycles.
+func (c *Context) fixtureKey(f *fixture, refs map[string]*fixture, visiting map[*fixture]bool) (*datastore.Key, error) {
+	if f.key != nil {
+		return f.key, nil
+	}
+	if visiting == nil {
+		visiting = make(map[*fixture]bool)
+	}
+	if visiting[f] {
+		return nil, fmt.Errorf("fixture $%s is its own ancestor", f.Ref)
+	}
+	visiting[f] = true
+	var parent *datastore.Key
+	if f.Parent != "" {
+		p, err := lookupFixture(f.Parent, refs)
+		if err != nil {
+			return nil, err
+		}
+		if p.Namespace != f.Namespace {
+			return nil, fmt.Errorf("fixture $%s must be in namespace %q like its parent $%s", f.Ref, p.Namespace, p.Ref)
+		}
+		if parent, err = c.fixtureKey(p, refs, visiting); err != nil {
+			return nil, err
+		}
+	}
+	nc, err := c.namespaced(f.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	f.key = datastore.NewKey(nc, f.Kind, f.KeyName, f.ID, parent)
+	return f.key, nil
+}
+
+func lookupFixture(ref string, refs map[string]*fixture) (*fixture, error) {
+	f := refs[strings.TrimPrefix(ref, "$")]
+	if f == nil {
+		return nil, fmt.Errorf("unknown fixture reference %s", ref)
+	}
+	if f.KeyName == "" && f.ID == 0 {
+		return nil, fmt.Errorf("fixture %s is referenced and needs a key_name or id", ref)
+	}
+	return f, nil
+}
+
+func fixtureProperties(f *fixture, refs map[string]*fixture) (datastore.PropertyList, error) {
+	names := make([]string, 0, len(f.Properties))
+	for name := range f.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var props datastore.PropertyList
+	for _, name := range names {
+		raw := f.Properties[name]
+		values, multiple := raw.([]interface{})
+		if !multiple {
+			values = []interface{}{raw}
+		}
+		for _, v := range values {
+			p, err := fixtureProperty(name, v, refs)
+			if err != nil {
+				return nil, fmt.Errorf("fixture %s property %s - %v", f.Kind, name, err)
+			}
+			p.Multiple = multiple
+			props = append(props, p)
+		}
+	}
+	return props, nil
+}
+
+func fixtureProperty(name string, v interface{}, refs map[string]*fixture) (datastore.Property, error) {
+	p := datastore.Property{Name: name}
+	switch v := v.(type) {
+	case nil:
+	case bool, int64, float64, time.Time:
+		p.Value = v
+	case int:
+		p.Value = int64(v)
+	case string:
+		if strings.HasPrefix(v, "$$") {
+			p.Value = v[1:]
+		} else if strings.HasPrefix(v, "$") {
+			ref, err := lookupFixture(v, refs)
+			if err != nil {
+				return p, err
+			}
+			p.Value = ref.key
+		} else {
+			p.Value = v
+		}
+	case map[interface{}]interface{}:
+		typed := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			typed[fmt.Sprint(k)] = val
+		}
+		value := typed["value"]
+		p.NoIndex, _ = typed["noindex"].(bool)
+		switch typed["type"] {
+		case nil:
+			vp, err := fixtureProperty(name, value, refs)
+			if err != nil {
+				return p, err
+			}
+			p.Value = vp.Value
+		case "time":
+			if t, ok := value.(time.Time); ok {
+				p.Value = t
+				break
+			}
+			t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(value))
+			if err != nil {
+				return p, err
+			}
+			p.Value = t
+		case "geopoint":
+			lat, ok1 := toFloat(typed["lat"])
+			lng, ok2 := toFloat(typed["lng"])
+			if !ok1 || !ok2 {
+				return p, fmt.Errorf("geopoint needs numeric lat and lng")
+			}
+			p.Value = appengine.GeoPoint{Lat: lat, Lng: lng}
+		case "key":
+			ref, err := lookupFixture(fmt.Sprint(value), refs)
+			if err != nil {
+				return p, err
+			}
+			p.Value = ref.key
+		case "blob":
+			b, err := base64.StdEncoding.DecodeString(fmt.Sprint(value))
+			if err != nil {
+				return p, err
+			}
+			p.Value = b
+			p.NoIndex = true
+		case "text":
+			p.Value = fmt.Sprint(value)
+			p.NoIndex = true
+		default:
+			return p, fmt.Errorf("unknown type %v", typed["type"])
+		}
+	default:
+		return p, fmt.Errorf("unsupported value %#v", v)
+	}
+	return p, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,338 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// GenerateOptions control optional behavior for Generate.
+type GenerateOptions struct {
+	// Seed of the random data. By default, 1, so that every run generates
+	// the same data.
+	Seed int64
+	// Store writes the generated entities to the datastore.
+	Store bool
+	// Kind of the stored entities. By default, the name of the struct type.
+	Kind   string
+	Parent *datastore.Key
+}
+
+var (
+	genFirstNames = []string{"Alice", "Bob", "Carol", "Dave", "Eve", "Frank", "Grace", "Heidi", "Ivan", "Judy", "Mallory", "Oscar", "Peggy", "Trent", "Victor", "Walter"}
+	genLastNames  = []string{"Smith", "Jones", "Brown", "Taylor", "Wilson", "Davies", "Evans", "Thomas", "Johnson", "Roberts", "Walker", "Wright"}
+	genWords      = []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "ut", "labore", "et", "dolore", "magna", "aliqua"}
+	genDomains    = []string{"example.com", "example.org", "example.net"}
+	genEpoch      = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Generate fills the slice dst points to with n structs of random data and,
+// with GenerateOptions.Store, puts them in the datastore, returning their
+// keys.  dst is a pointer to a slice of structs or of pointers to structs;
+// the generated structs are appended to it.  A nil opts is valid.
+//
+// The gen struct tag controls the data of a field:
+//
+//	gen:"-"                 leave the field alone
+//	gen:"email"             an email address
+//	gen:"name"              a full name; also "firstname" and "lastname"
+//	gen:"word"              a word; also "sentence" and "paragraph"
+//	gen:"url"               a URL
+//	gen:"range=1,100"       a number in [1, 100], or a time between two RFC 3339 times
+//	gen:"oneof=a|b|c"       one of the values, converted to the field's type
+//	gen:"len=5"             the number of elements of a slice or runes of a string
+//
+// Fields without a tag get a random value for their type.  Fields ignored by
+// the datastore, with a datastore:"-" tag, are left alone too.
+func Generate(c appengine.Context, dst interface{}, n int, opts *GenerateOptions) ([]*datastore.Key, error) {
+	if opts == nil {
+		opts = &GenerateOptions{}
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("Generate needs a number of structs of 0 or more, got %d", n)
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("Generate needs a pointer to a slice, got %T", dst)
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Generate needs a slice of structs, got %T", dst)
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = 1
+	}
+	g := &generator{rand: rand.New(rand.NewSource(seed))}
+
+	start := slice.Len()
+	for i := 0; i < n; i++ {
+		s := reflect.New(structType)
+		if err := g.fillStruct(s.Elem()); err != nil {
+			return nil, err
+		}
+		if elemType.Kind() == reflect.Ptr {
+			slice = reflect.Append(slice, s)
+		} else {
+			slice = reflect.Append(slice, s.Elem())
+		}
+	}
+	v.Elem().Set(slice)
+	if !opts.Store || n == 0 {
+		return nil, nil
+	}
+
+	kind := opts.Kind
+	if kind == "" {
+		kind = structType.Name()
+	}
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, kind, opts.Parent)
+	}
+	var stored []*datastore.Key
+	for i := 0; i < n; i += maxPutMulti {
+		end := i + maxPutMulti
+		if end > n {
+			end = n
+		}
+		ks, err := datastore.PutMulti(c, keys[i:end], slice.Slice(start+i, start+end).Interface())
+		if err != nil {
+			return stored, err
+		}
+		stored = append(stored, ks...)
+	}
+	return stored, nil
+}
+
+type generator struct {
+	rand *rand.Rand
+}
+
+func (g *generator) fillStruct(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("gen") == "-" || f.Tag.Get("datastore") == "-" {
+			continue
+		}
+		if err := g.fill(v.Field(i), f.Tag.Get("gen")); err != nil {
+			return fmt.Errorf("generating %s.%s - %v", t.Name(), f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (g *generator) pick(list []string) string {
+	return list[g.rand.Intn(len(list))]
+}
+
+func (g *generator) words(n int) string {
+	w := make([]string, n)
+	for i := range w {
+		w[i] = g.pick(genWords)
+	}
+	return strings.Join(w, " ")
+}
+
+func (g *generator) fill(v reflect.Value, tag string) error {
+	name, arg := tag, ""
+	if i := strings.Index(tag, "="); i >= 0 {
+		name, arg = tag[:i], tag[i+1:]
+	}
+	switch name {
+	case "email", "name", "firstname", "lastname", "word", "sentence", "paragraph", "url":
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("gen:%q needs a string field", tag)
+		}
+		v.SetString(g.text(name))
+		return nil
+	case "oneof":
+		return setString(v, g.pick(strings.Split(arg, "|")))
+	case "range":
+		bounds := strings.SplitN(arg, ",", 2)
+		if len(bounds) != 2 {
+			return fmt.Errorf("gen:%q needs two bounds", tag)
+		}
+		return g.fillRange(v, bounds[0], bounds[1])
+	case "len":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("gen:%q needs a number", tag)
+		}
+		return g.fillLen(v, n)
+	case "":
+		return g.fillDefault(v)
+	}
+	return fmt.Errorf("unknown gen tag %q", tag)
+}
+
+func (g *generator) text(name string) string {
+	switch name {
+	case "email":
+		return fmt.Sprintf("%s.%s%d@%s", strings.ToLower(g.pick(genFirstNames)), strings.ToLower(g.pick(genLastNames)), g.rand.Intn(1000), g.pick(genDomains))
+	case "name":
+		return g.pick(genFirstNames) + " " + g.pick(genLastNames)
+	case "firstname":
+		return g.pick(genFirstNames)
+	case "lastname":
+		return g.pick(genLastNames)
+	case "sentence":
+		s := g.words(4 + g.rand.Intn(8))
+		return strings.ToUpper(s[:1]) + s[1:] + "."
+	case "paragraph":
+		s := make([]string, 3+g.rand.Intn(4))
+		for i := range s {
+			s[i] = g.text("sentence")
+		}
+		return strings.Join(s, " ")
+	case "url":
+		return fmt.Sprintf("http://%s/%s", g.pick(genDomains), g.pick(genWords))
+	}
+	return g.pick(genWords)
+}
+
+func (g *generator) fillRange(v reflect.Value, lo, hi string) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		a, err1 := strconv.ParseInt(lo, 10, 64)
+		b, err2 := strconv.ParseInt(hi, 10, 64)
+		if err1 != nil || err2 != nil || b < a {
+			return fmt.Errorf("invalid range %s,%s", lo, hi)
+		}
+		if v.OverflowInt(a) || v.OverflowInt(b) {
+			return fmt.Errorf("range %s,%s overflows %s", lo, hi, v.Type())
+		}
+		v.SetInt(a + g.rand.Int63n(b-a+1))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		a, err1 := strconv.ParseFloat(lo, 64)
+		b, err2 := strconv.ParseFloat(hi, 64)
+		if err1 != nil || err2 != nil || b < a {
+			return fmt.Errorf("invalid range %s,%s", lo, hi)
+		}
+		if v.OverflowFloat(a) || v.OverflowFloat(b) {
+			return fmt.Errorf("range %s,%s overflows %s", lo, hi, v.Type())
+		}
+		v.SetFloat(a + g.rand.Float64()*(b-a))
+		return nil
+	}
+	if v.Type() == reflect.TypeOf(time.Time{}) {
+		a, err1 := time.Parse(time.RFC3339, lo)
+		b, err2 := time.Parse(time.RFC3339, hi)
+		if err1 != nil || err2 != nil || b.Before(a) {
+			return fmt.Errorf("invalid range %s,%s", lo, hi)
+		}
+		v.Set(reflect.ValueOf(a.Add(time.Duration(g.rand.Int63n(int64(b.Sub(a)) + 1)))))
+		return nil
+	}
+	return fmt.Errorf("range not supported for %s", v.Type())
+}
+
+func (g *generator) fillLen(v reflect.Value, n int) error {
+	switch v.Kind() {
+	case reflect.String:
+		r := make([]rune, n)
+		for i := range r {
+			r[i] = rune('a' + g.rand.Intn(26))
+		}
+		v.SetString(string(r))
+		return nil
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := g.fillDefault(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return fmt.Errorf("len not supported for %s", v.Type())
+}
+
+func (g *generator) fillDefault(v reflect.Value) error {
+	switch v.Type() {
+	case reflect.TypeOf(time.Time{}):
+		// within a year of genEpoch, at datastore (microsecond) precision
+		v.Set(reflect.ValueOf(genEpoch.Add(time.Duration(g.rand.Int63n(int64(365*24*time.Hour)/1e3)) * time.Microsecond)))
+		return nil
+	case reflect.TypeOf(appengine.GeoPoint{}):
+		v.Set(reflect.ValueOf(appengine.GeoPoint{Lat: g.rand.Float64()*180 - 90, Lng: g.rand.Float64()*360 - 180}))
+		return nil
+	case reflect.TypeOf(&datastore.Key{}), reflect.TypeOf(appengine.BlobKey("")):
+		return nil // references can't be made up
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(g.pick(genWords))
+	case reflect.Bool:
+		v.SetBool(g.rand.Intn(2) == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// below 1000, or 100 for an int8
+		max := int64(1000)
+		if v.OverflowInt(max - 1) {
+			max = 100
+		}
+		v.SetInt(g.rand.Int63n(max))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(g.rand.Float64() * 1000)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, 16)
+			g.rand.Read(b)
+			v.SetBytes(b)
+			return nil
+		}
+		return g.fillLen(v, 1+g.rand.Intn(3))
+	case reflect.Struct:
+		return g.fillStruct(v)
+	}
+	return nil
+}
+
+// setString sets v to s converted to v's type.
+func setString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("%s overflows %s", s, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if v.OverflowFloat(f) {
+			return fmt.Errorf("%s overflows %s", s, v.Type())
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("oneof not supported for %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// indexYAMLMu serializes the updates of index.yaml files by Contexts closing
+// concurrently.
+var indexYAMLMu sync.Mutex
+
+// Index is a composite datastore index as defined in index.yaml.
+type Index struct {
+	Kind       string          `yaml:"kind"`
+	Ancestor   bool            `yaml:"ancestor"`
+	Properties []IndexProperty `yaml:"properties"`
+}
+
+// IndexProperty is a property of a composite index.
+type IndexProperty struct {
+	Name      string `yaml:"name"`
+	Direction string `yaml:"direction"` // "asc" (the default) or "desc"
+}
+
+// key identifies the index regardless of formatting.
+func (i Index) key() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s|%t", i.Kind, i.Ancestor)
+	for _, p := range i.Properties {
+		dir := p.Direction
+		if dir == "" {
+			dir = "asc"
+		}
+		fmt.Fprintf(&buf, "|%s %s", p.Name, dir)
+	}
+	return buf.String()
+}
+
+// YAML returns the index formatted as an entry of index.yaml.
+func (i Index) YAML() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "- kind: %s\n", i.Kind)
+	if i.Ancestor {
+		buf.WriteString("  ancestor: yes\n")
+	}
+	if len(i.Properties) > 0 {
+		buf.WriteString("  properties:\n")
+	}
+	for _, p := range i.Properties {
+		fmt.Fprintf(&buf, "  - name: %s\n", p.Name)
+		if p.Direction == "desc" {
+			buf.WriteString("    direction: desc\n")
+		}
+	}
+	return buf.String()
+}
+
+func parseIndexYAML(data []byte) ([]Index, error) {
+	var file struct {
+		Indexes []Index `yaml:"indexes"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Indexes, nil
+}
+
+// mergeIndexYAML appends the indexes missing from the index.yaml at path and
+// returns them.  The existing content of the file, including comments, is
+// kept as is.
+func mergeIndexYAML(path string, indexes []Index) ([]Index, error) {
+	indexYAMLMu.Lock()
+	defer indexYAMLMu.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	existing, err := parseIndexYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s - %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, i := range existing {
+		seen[i.key()] = true
+	}
+	var added []Index
+	for _, i := range indexes {
+		if seen[i.key()] {
+			continue
+		}
+		seen[i.key()] = true
+		added = append(added, i)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	buf := bytes.NewBuffer(data)
+	if len(bytes.TrimSpace(data)) == 0 {
+		buf.Reset()
+		buf.WriteString("indexes:\n\n# AUTOGENERATED\n")
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	for _, i := range added {
+		buf.WriteString("\n")
+		buf.WriteString(i.YAML())
+	}
+	return added, ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// collectIndexes merges the indexes dev_appserver.py generated in fakeAppDir
+// into the project's index.yaml and logs the ones that were added.
+func (c *Context) collectIndexes() {
+	if c.indexYAMLPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.fakeAppDir, "index.yaml"))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		c.logf(LogError, "Could not read the generated index.yaml - %v", err)
+		return
+	}
+	indexes, err := parseIndexYAML(data)
+	if err != nil {
+		c.logf(LogError, "Could not parse the generated index.yaml - %v", err)
+		return
+	}
+	added, err := mergeIndexYAML(c.indexYAMLPath, indexes)
+	if err != nil {
+		c.logf(LogError, "Could not update %s - %v", c.indexYAMLPath, err)
+		return
+	}
+	if len(added) == 0 {
+		return
+	}
+	diff := make([]string, 0, len(added))
+	for _, i := range added {
+		diff = append(diff, "+"+strings.Replace(strings.TrimSuffix(i.YAML(), "\n"), "\n", "\n+", -1))
+	}
+	msg := fmt.Sprintf("added %d indexes to %s:\n%s", len(added), c.indexYAMLPath, strings.Join(diff, "\n"))
+	// shown regardless of the LogLevel as the project's files changed
+	if c.testing == nil {
+		log.Println(msg)
+	} else {
+		c.testing.Log(msg)
+	}
+}
+
+// MissingIndexError is returned for a query that needs a composite index
+// which is missing from index.yaml when Options.RequireIndexes is set.
+type MissingIndexError struct {
+	Index  Index  // the minimum index the query needs
+	Detail string // the error reported by the datastore
+}
+
+func (e *MissingIndexError) Error() string {
+	props := make([]string, 0, len(e.Index.Properties))
+	for _, p := range e.Index.Properties {
+		props = append(props, p.Name)
+	}
+	return fmt.Sprintf("query on kind %s needs a composite index on %s, add to index.yaml:\n%s",
+		e.Index.Kind, strings.Join(props, ", "), e.Index.YAML())
+}
+
+// missingIndexError returns a *MissingIndexError if body is the datastore's
+// error for a query without the composite index it needs, otherwise nil.
+func missingIndexError(service string, body []byte) error {
+	if service != "datastore_v3" || !bytes.Contains(body, []byte("NEED_INDEX")) {
+		return nil
+	}
+	start := bytes.Index(body, []byte("- kind:"))
+	if start < 0 {
+		return nil
+	}
+	var indexes []Index
+	if err := yaml.Unmarshal(body[start:], &indexes); err != nil || len(indexes) == 0 {
+		return nil
+	}
+	return &MissingIndexError{Index: indexes[0], Detail: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,95 @@
+package appenginetesting
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// maxLogEntries is the number of log entries a Context keeps; older ones are
+// dropped first.
+const maxLogEntries = 10000
+
+// Sources of log entries.
+const (
+	SourceContext = "context" // logged through the Context's Debugf, Infof, etc.
+	SourceChild   = "child"   // output of the dev_appserver.py process
+)
+
+// LogEntry is a log line captured by a Context.
+type LogEntry struct {
+	Level     LogLevel
+	Time      time.Time
+	Message   string
+	Source    string
+	Module    string // module serving the request, for child output
+	RequestID string // for child output that names the request
+}
+
+// record adds an entry to the Context's log buffer.  Entries are kept
+// whatever the Context's LogLevel is.  c.logMu must be held.
+func (c *Context) record(e LogEntry) {
+	if len(c.logs) >= maxLogEntries {
+		c.logs = c.logs[1:]
+	}
+	c.logs = append(c.logs, e)
+}
+
+// Logs returns the captured log entries of the given level or above, oldest
+// first.
+//
+// Logs is not part of the appengine.Context interface.
+func (c *Context) Logs(level LogLevel) []LogEntry {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	var entries []LogEntry
+	for _, e := range c.logs {
+		if e.Level >= level {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// AssertLogged fails t unless an entry of the given level or above matches
+// re.
+//
+// AssertLogged is not part of the appengine.Context interface.
+func (c *Context) AssertLogged(t *testing.T, level LogLevel, re *regexp.Regexp) {
+	t.Helper()
+	for _, e := range c.Logs(level) {
+		if re.MatchString(e.Message) {
+			return
+		}
+	}
+	t.Errorf("Nothing logged at level %s or above matches %s", level, re)
+}
+
+// AssertNoErrors fails t for every entry logged at LogError or above.
+//
+// AssertNoErrors is not part of the appengine.Context interface.
+func (c *Context) AssertNoErrors(t *testing.T) {
+	t.Helper()
+	for _, e := range c.Logs(LogError) {
+		t.Errorf("Unexpected %s log from %s at %s: %s", e.Level, e.Source, e.Time.Format(time.RFC3339), e.Message)
+	}
+}
+
+// detachLog stops writing log entries to the Context's *testing.T, which
+// panics when logged to after its test has returned.  Later entries go to
+// the standard logger.  It is called when the Context is closed and when the
+// child's output has been read to the end.
+func (c *Context) detachLog() {
+	c.logMu.Lock()
+	c.detached = true
+	c.logMu.Unlock()
+}
+
+// testEnded detaches the log of a Context whose test has returned, and stops
+// a later crash of the child from failing it.
+func (c *Context) testEnded() {
+	c.logMu.Lock()
+	c.detached = true
+	c.testDone = true
+	c.logMu.Unlock()
+}
@@ -0,0 +1,94 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrChildExited is returned by the calls of a Context whose dev_appserver.py
+// exited before Close, with the end of its output.
+type ErrChildExited struct {
+	Status string // like "exit status 1" or "signal: killed"
+	Tail   []string
+}
+
+func (e *ErrChildExited) Error() string {
+	s := "dev_appserver.py exited during the test - " + e.Status
+	if len(e.Tail) > 0 {
+		s += fmt.Sprintf("\nlast %d lines of output:\n\t%s", len(e.Tail), strings.Join(e.Tail, "\n\t"))
+	}
+	return s
+}
+
+// monitorChild waits for the child to exit.  An exit between the start of the
+// child and Close is a crash: it fails the test if it hasn't returned yet,
+// whatever the Context's LogLevel, and the calls made from then on.
+func (c *Context) monitorChild(p *os.Process, outputDone <-chan struct{}) {
+	state, err := p.Wait()
+	status := "unknown status"
+	switch {
+	case err != nil:
+		status = err.Error()
+	case state != nil:
+		status = state.String()
+	}
+	// let the rest of the output be read
+	select {
+	case <-outputDone:
+	case <-time.After(startupGrace):
+	}
+
+	c.mu.Lock()
+	crashed := c.running
+	if crashed {
+		c.running = false
+		c.childExit = &ErrChildExited{Status: status, Tail: c.output.get()}
+	}
+	c.mu.Unlock()
+	defer close(c.exited)
+	if !crashed {
+		return
+	}
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	c.record(LogEntry{Level: LogError, Time: time.Now(), Message: c.childExit.Error(), Source: SourceContext})
+	// the test can't return on a call failing with the crash before it is
+	// reported, but it may have returned without calling Close
+	if c.testing != nil && !c.testDone {
+		c.testing.Errorf("%v", c.childExit)
+	} else {
+		log.Println(c.childExit)
+	}
+}
+
+// childExited returns the ErrChildExited of a crashed child, or nil.
+func (c *Context) childExited() error {
+	select {
+	case <-c.exited:
+	default:
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.childExit == nil {
+		return nil // not a crash
+	}
+	return c.childExit
+}
+
+// callError returns the ErrChildExited of a crash that caused err, a failed
+// request to the child, or else err.
+func (c *Context) callError(err error) error {
+	select {
+	case <-c.exited:
+	case <-time.After(2 * startupGrace):
+		return err
+	}
+	if exitErr := c.childExited(); exitErr != nil {
+		return exitErr
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+// +build !windows
+
+package appenginetesting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, which the Go
+// app instances started by dev_appserver.py join.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to the process group led by p.  A group that is
+// already gone is not an error.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-p.Pid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+func terminateGroup(p *os.Process) error {
+	return signalGroup(p, syscall.SIGTERM)
+}
+
+func killGroup(p *os.Process) error {
+	return signalGroup(p, syscall.SIGKILL)
+}
+
+// groupAlive reports whether a process of the group led by pid is running.
+func groupAlive(pid int) bool {
+	return syscall.Kill(-pid, 0) == nil
+}
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// processCommand returns the command line of the process pid, its arguments
+// separated by spaces.
+func processCommand(pid int) (string, error) {
+	if data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		return strings.TrimSpace(strings.Replace(string(data), "\x00", " ", -1)), nil
+	}
+	out, err := exec.Command("ps", "-ww", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,58 @@
+package appenginetesting
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the root of a new process group, so that its
+// process tree can be terminated with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// terminateGroup asks the process tree of p to exit.  Windows has no SIGTERM,
+// so taskkill closes the processes' windows.
+func terminateGroup(p *os.Process) error {
+	return taskkill(p, "/T")
+}
+
+func killGroup(p *os.Process) error {
+	return taskkill(p, "/T", "/F")
+}
+
+// taskkill runs taskkill on the process tree of p.  A process that is
+// already gone is not an error.
+func taskkill(p *os.Process, args ...string) error {
+	out, err := exec.Command("taskkill", append(args, "/PID", strconv.Itoa(p.Pid))...).CombinedOutput()
+	if err == nil || !processAlive(p.Pid) {
+		return nil
+	}
+	return fmt.Errorf("taskkill %s: %v - %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+}
+
+// groupAlive reports whether the process pid is running.
+func groupAlive(pid int) bool {
+	return processAlive(pid)
+}
+
+// processAlive reports whether the process pid is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// processCommand is not supported on Windows.
+func processCommand(pid int) (string, error) {
+	return "", errors.New("reading the command line of a process is not supported on Windows")
+}
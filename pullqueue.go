@@ -0,0 +1,133 @@
+package appenginetesting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	taskqueuepb "appengine_internal/taskqueue"
+)
+
+// maxPullTasks is the number of tasks PullTasks inspects in a queue.
+const maxPullTasks = 1000
+
+// PullTask is the state of a task in a pull queue.
+type PullTask struct {
+	Name       string
+	Payload    []byte
+	Tag        string
+	ETA        time.Time // on the Clock's timeline; the end of the lease for a leased task
+	RetryCount int       // number of times the task has been leased
+	Leased     bool
+}
+
+// PullTasks returns the tasks in the pull queue, both available and leased.
+//
+// PullTasks is not part of the appengine.Context interface.
+func (c *Context) PullTasks(queue string) ([]PullTask, error) {
+	req := &taskqueuepb.TaskQueueQueryTasksRequest{
+		QueueName: []byte(queue),
+		MaxRows:   proto.Int32(maxPullTasks),
+	}
+	res := &taskqueuepb.TaskQueueQueryTasksResponse{}
+	if err := c.call("taskqueue", "QueryTasks", req, res); err != nil {
+		return nil, err
+	}
+	offset := c.clock.Offset()
+	now := time.Now()
+	tasks := make([]PullTask, 0, len(res.Task))
+	for _, task := range res.Task {
+		eta := time.Unix(0, task.GetEtaUsec()*1e3)
+		tasks = append(tasks, PullTask{
+			Name:       string(task.TaskName),
+			Payload:    task.Body,
+			Tag:        string(task.Tag),
+			ETA:        eta.Add(offset),
+			RetryCount: int(task.GetRetryCount()),
+			Leased:     task.GetRetryCount() > 0 && eta.After(now),
+		})
+	}
+	return tasks, nil
+}
+
+// LeasedTasks returns the tasks in the pull queue that are currently leased.
+//
+// LeasedTasks is not part of the appengine.Context interface.
+func (c *Context) LeasedTasks(queue string) ([]PullTask, error) {
+	return c.filterPullTasks(queue, true)
+}
+
+// AvailableTasks returns the tasks in the pull queue that are not leased.
+//
+// AvailableTasks is not part of the appengine.Context interface.
+func (c *Context) AvailableTasks(queue string) ([]PullTask, error) {
+	return c.filterPullTasks(queue, false)
+}
+
+func (c *Context) filterPullTasks(queue string, leased bool) ([]PullTask, error) {
+	tasks, err := c.PullTasks(queue)
+	if err != nil {
+		return nil, err
+	}
+	filtered := tasks[:0]
+	for _, task := range tasks {
+		if task.Leased == leased {
+			filtered = append(filtered, task)
+		}
+	}
+	return filtered, nil
+}
+
+// ExpireLeases ends every lease in the pull queue, making the tasks available
+// again as if their lease time had passed.
+//
+// ExpireLeases is not part of the appengine.Context interface.
+func (c *Context) ExpireLeases(queue string) error {
+	tasks, err := c.PullTasks(queue)
+	if err != nil {
+		return err
+	}
+	offset := c.clock.Offset()
+	for _, task := range tasks {
+		if !task.Leased {
+			continue
+		}
+		err = c.call("taskqueue", "ModifyTaskLease", &taskqueuepb.TaskQueueModifyTaskLeaseRequest{
+			QueueName:    []byte(queue),
+			TaskName:     []byte(task.Name),
+			EtaUsec:      proto.Int64(task.ETA.Add(-offset).UnixNano() / 1e3),
+			LeaseSeconds: proto.Float64(0),
+		}, &taskqueuepb.TaskQueueModifyTaskLeaseResponse{})
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		delete(c.clockTasks, clockTask{queue: queue, name: task.Name}.id())
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// AssertLeased fails t unless want tasks in the pull queue are leased.  A
+// non-empty tag only counts the leased tasks with that tag, which checks the
+// outcome of taskqueue.LeaseByTag.
+//
+// AssertLeased is not part of the appengine.Context interface.
+func (c *Context) AssertLeased(t *testing.T, queue, tag string, want int) {
+	t.Helper()
+	tasks, err := c.LeasedTasks(queue)
+	if err != nil {
+		t.Errorf("Could not inspect pull queue %s - %v", queue, err)
+		return
+	}
+	got := 0
+	for _, task := range tasks {
+		if tag == "" || task.Tag == tag {
+			got++
+		}
+	}
+	if got != want {
+		t.Errorf("Pull queue %s has %d leased tasks with tag %q, want %d", queue, got, tag, want)
+	}
+}
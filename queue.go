@@ -0,0 +1,76 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	defaultQueueRate         = "35/s"
+	defaultQueueStorageLimit = "120M"
+)
+
+// QueueConfig describes a task queue the same way an entry in queue.yaml
+// does.  Zero values are left out of the generated queue.yaml so that the
+// dev_appserver defaults apply.
+type QueueConfig struct {
+	Name                  string
+	Mode                  string // "push" (the default) or "pull"
+	Rate                  string // e.g. "5/s", push queues only, defaults to 35/s
+	BucketSize            int    // push queues only
+	MaxConcurrentRequests int    // push queues only
+	Target                string // module or version tasks are sent to, push queues only
+	RetryParameters       *RetryParameters
+	ACL                   []QueueACL // pull queues only
+}
+
+// RetryParameters mirrors the retry_parameters section of a queue.yaml entry.
+type RetryParameters struct {
+	TaskRetryLimit    *int   // nil leaves the limit unset, zero disables retries
+	TaskAgeLimit      string // e.g. "2d"
+	MinBackoffSeconds float64
+	MaxBackoffSeconds float64
+	MaxDoublings      int
+}
+
+// QueueACL is one entry in the acl section of a pull queue.  Only one of the
+// fields should be set.
+type QueueACL struct {
+	UserEmail   string
+	WriterEmail string
+}
+
+func (q QueueConfig) validate() error {
+	if q.Name == "" {
+		return fmt.Errorf("QueueConfig requires a Name")
+	}
+	switch q.Mode {
+	case "", "push":
+		if len(q.ACL) > 0 {
+			return fmt.Errorf("queue %s - ACL is only supported for pull queues", q.Name)
+		}
+	case "pull":
+		if q.Rate != "" || q.BucketSize != 0 || q.MaxConcurrentRequests != 0 || q.Target != "" {
+			return fmt.Errorf("queue %s - Rate, BucketSize, MaxConcurrentRequests and Target are not supported for pull queues", q.Name)
+		}
+	default:
+		return fmt.Errorf("queue %s - Mode given %s, not a valid option, use one of push or pull", q.Name, q.Mode)
+	}
+	for _, acl := range q.ACL {
+		if (acl.UserEmail == "") == (acl.WriterEmail == "") {
+			return fmt.Errorf("queue %s - each QueueACL needs exactly one of UserEmail or WriterEmail", q.Name)
+		}
+	}
+	return nil
+}
+
+// writeQueueYAML renders queues in queue.yaml format.
+func writeQueueYAML(w io.Writer, storageLimit string, queues []QueueConfig) error {
+	if storageLimit == "" {
+		storageLimit = defaultQueueStorageLimit
+	}
+	return queueTempl.Execute(w, struct {
+		StorageLimit string
+		Queues       []QueueConfig
+	}{storageLimit, queues})
+}
@@ -4,10 +4,26 @@ import (
 	"text/template"
 )
 
-const queueTemplString = `total_storage_limit: 120M
-queue:{{range .}}
-- name: {{.}}
-  rate: 35/s{{end}}
+const queueTemplString = `total_storage_limit: {{.StorageLimit}}
+queue:{{range .Queues}}
+- name: {{.Name}}{{if eq .Mode "pull"}}
+  mode: pull{{else}}
+  rate: {{if .Rate}}{{.Rate}}{{else}}{{defaultQueueRate}}{{end}}{{end}}{{if .BucketSize}}
+  bucket_size: {{.BucketSize}}{{end}}{{if .MaxConcurrentRequests}}
+  max_concurrent_requests: {{.MaxConcurrentRequests}}{{end}}{{if .Target}}
+  target: {{.Target}}{{end}}{{with .RetryParameters}}
+  retry_parameters:{{if .TaskRetryLimit}}
+    task_retry_limit: {{deref .TaskRetryLimit}}{{end}}{{if .TaskAgeLimit}}
+    task_age_limit: {{.TaskAgeLimit}}{{end}}{{if .MinBackoffSeconds}}
+    min_backoff_seconds: {{.MinBackoffSeconds}}{{end}}{{if .MaxBackoffSeconds}}
+    max_backoff_seconds: {{.MaxBackoffSeconds}}{{end}}{{if .MaxDoublings}}
+    max_doublings: {{.MaxDoublings}}{{end}}{{end}}{{if .ACL}}
+  acl:{{range .ACL}}{{if .UserEmail}}
+  - user_email: {{.UserEmail}}{{end}}{{if .WriterEmail}}
+  - writer_email: {{.WriterEmail}}{{end}}{{end}}{{end}}{{end}}
 `
 
-var queueTempl = template.Must(template.New("queue.yaml").Parse(queueTemplString))
+var queueTempl = template.Must(template.New("queue.yaml").Funcs(template.FuncMap{
+	"defaultQueueRate": func() string { return defaultQueueRate },
+	"deref":            func(i *int) int { return *i },
+}).Parse(queueTemplString))
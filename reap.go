@@ -0,0 +1,128 @@
+package appenginetesting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pidFileName holds the pid of the child in fakeAppDir.
+	pidFileName = "dev_appserver.pid"
+	// ownerFileName holds the owner metadata in fakeAppDir.
+	ownerFileName = "owner.json"
+	// reapAge is the age after which a fakeAppDir without owner metadata
+	// is reaped.
+	reapAge = 24 * time.Hour
+)
+
+// owner describes the test binary that started a child, so that it can be
+// cleaned up once the test binary is gone.
+type owner struct {
+	PID       int       `json:"pid"`
+	Args      []string  `json:"args"`
+	Started   time.Time `json:"started"`
+	ChildPID  int       `json:"child_pid"`
+	ChildArgs []string  `json:"child_args"`
+	Keep      bool      `json:"keep_temp_dir"`
+}
+
+// reapOnce runs Reap in the background when the first Context is created.
+var reapOnce sync.Once
+
+// writeOwner records the child and the running test binary in fakeAppDir.
+func (c *Context) writeOwner() error {
+	pid := c.child.Process.Pid
+	err := ioutil.WriteFile(filepath.Join(c.fakeAppDir, pidFileName), []byte(strconv.Itoa(pid)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(owner{
+		PID:       os.Getpid(),
+		Args:      os.Args,
+		Started:   time.Now(),
+		ChildPID:  pid,
+		ChildArgs: c.child.Args,
+		Keep:      c.keepTempDir,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.fakeAppDir, ownerFileName), data, 0644)
+}
+
+// Reap cleans up after the test binaries that were killed before they closed
+// their Contexts: the dev_appserver.py processes they started are killed and
+// their application files removed, unless kept through the configuration.
+// Application files without an owner are removed once a day old.  A process
+// is only killed if its command line is still the one of the recorded
+// dev_appserver.py; where it can't be read, as on Windows, the process and its
+// files are left alone.  Reap runs in the background when the first Context of
+// a test binary is created; it returns the directories it cleaned up.
+func Reap() ([]string, error) {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), aeFakeName+"*"))
+	if err != nil {
+		return nil, err
+	}
+	var reaped []string
+	for _, dir := range dirs {
+		if reapDir(dir) {
+			reaped = append(reaped, dir)
+		}
+	}
+	return reaped, nil
+}
+
+// reapDir cleans up dir if its owner is gone, and reports whether it did.
+func reapDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ownerFileName))
+	if err != nil {
+		if os.IsNotExist(err) && time.Since(fi.ModTime()) > reapAge {
+			os.RemoveAll(dir)
+			return true
+		}
+		return false
+	}
+	var o owner
+	if err = json.Unmarshal(data, &o); err != nil || o.PID == 0 || processAlive(o.PID) {
+		return false
+	}
+	if o.ChildPID != 0 && processAlive(o.ChildPID) {
+		cmdline, err := processCommand(o.ChildPID)
+		if err != nil || len(o.ChildArgs) == 0 {
+			return false // can't tell if it is still the child
+		}
+		// otherwise the pid was reused and the child is gone
+		if sameCommand(o.ChildArgs, cmdline) {
+			if p, err := os.FindProcess(o.ChildPID); err == nil {
+				killGroup(p)
+			}
+		}
+	}
+	if o.Keep {
+		// reaped once only, the files are left for inspection
+		os.Remove(filepath.Join(dir, ownerFileName))
+	} else {
+		os.RemoveAll(dir)
+	}
+	return true
+}
+
+// sameCommand reports whether cmdline, the command line of a running process,
+// is the one of a process started with args.  The program itself is left out,
+// as it may show up resolved to another path.
+func sameCommand(args []string, cmdline string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	return strings.Contains(cmdline, strings.Join(args[1:], " "))
+}
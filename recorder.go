@@ -18,8 +18,9 @@ func NewContextRecorder(opts *Options) *ContextRecorder {
 
 	creator := func(r *http.Request) appengine.Context {
 		recorder.c = &Context{
-			appid: opts.appId(),
-			req:   r,
+			appid:          opts.appId(),
+			req:            r,
+			clearDatastore: opts.clearDatastore(),
 		}
 
 		if err := recorder.c.startChild(); err != nil {
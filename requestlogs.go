@@ -0,0 +1,164 @@
+package appenginetesting
+
+import (
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	logpb "appengine_internal/log"
+)
+
+// requestLogBatch is the number of request logs read from the child at once.
+const requestLogBatch = 100
+
+// RequestLogFilter selects the request logs returned by RequestLogs.  The
+// zero value selects every completed request served by the modules of the
+// Context.
+type RequestLogFilter struct {
+	Modules    []string  // by default, every module in Options.Modules
+	Since      time.Time // only requests started at or after Since
+	MinLevel   LogLevel  // only requests with an app log line of MinLevel or above, if above LogChild
+	RequestIDs []string
+	Incomplete bool // include requests still being served
+}
+
+// AppLogLine is a line logged by the application while serving a request.
+type AppLogLine struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+}
+
+// RequestLog is the log record of a request served by a module.
+type RequestLog struct {
+	RequestID string
+	Module    string
+	Version   string
+	Method    string
+	URL       string // path and query of the request
+	Status    int
+	StartTime time.Time
+	EndTime   time.Time
+	Latency   time.Duration
+	AppLogs   []AppLogLine
+}
+
+// Logged reports whether the application logged a line of the given level or
+// above matching re while serving the request.
+func (r *RequestLog) Logged(level LogLevel, re *regexp.Regexp) bool {
+	for _, l := range r.AppLogs {
+		if l.Level >= level && re.MatchString(l.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleVersion returns the version in the module's yaml file.
+func moduleVersion(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "1"
+	}
+	var conf struct {
+		Version string `yaml:"version"`
+	}
+	if yaml.Unmarshal(data, &conf) != nil || conf.Version == "" {
+		return "1"
+	}
+	return conf.Version
+}
+
+// RequestLogs queries the child's log service for the requests served by the
+// application's modules, oldest first.  A nil filter is valid and selects
+// every completed request.
+//
+// RequestLogs is not part of the appengine.Context interface.
+func (c *Context) RequestLogs(filter *RequestLogFilter) ([]RequestLog, error) {
+	if filter == nil {
+		filter = &RequestLogFilter{}
+	}
+	req := &logpb.LogReadRequest{
+		AppId:             proto.String(c.FullyQualifiedAppID()),
+		IncludeAppLogs:    proto.Bool(true),
+		IncludeIncomplete: proto.Bool(filter.Incomplete),
+		Count:             proto.Int64(requestLogBatch),
+	}
+	wanted := make(map[string]bool)
+	for _, name := range filter.Modules {
+		wanted[name] = true
+	}
+	for _, m := range c.modules {
+		if m.Name == aeFakeName || (len(wanted) > 0 && !wanted[m.Name]) {
+			continue
+		}
+		req.ModuleVersion = append(req.ModuleVersion, &logpb.LogModuleVersion{
+			ModuleId:  proto.String(m.Name),
+			VersionId: proto.String(moduleVersion(m.Path)),
+		})
+	}
+	if len(req.ModuleVersion) == 0 {
+		return nil, nil
+	}
+	if !filter.Since.IsZero() {
+		req.StartTime = proto.Int64(filter.Since.UnixNano() / 1e3)
+	}
+	if filter.MinLevel > LogChild {
+		req.MinimumLogLevel = proto.Int32(int32(filter.MinLevel - LogDebug))
+	}
+	for _, id := range filter.RequestIDs {
+		req.RequestId = append(req.RequestId, []byte(id))
+	}
+
+	var logs []RequestLog
+	for {
+		res := &logpb.LogReadResponse{}
+		if err := c.call("logservice", "Read", req, res); err != nil {
+			return nil, err
+		}
+		for _, rl := range res.Log {
+			if rl.GetResource() == probePath && rl.GetUserAgent() == probeUserAgent {
+				continue // sent by NewContext
+			}
+			logs = append(logs, newRequestLog(rl))
+		}
+		if res.Offset == nil || len(res.Log) == 0 {
+			break
+		}
+		req.Offset = res.Offset
+	}
+	// the log service returns the newest requests first
+	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+		logs[i], logs[j] = logs[j], logs[i]
+	}
+	return logs, nil
+}
+
+func usecTime(usec int64) time.Time {
+	return time.Unix(0, usec*1e3)
+}
+
+func newRequestLog(rl *logpb.RequestLog) RequestLog {
+	r := RequestLog{
+		RequestID: string(rl.RequestId),
+		Module:    rl.GetModuleId(),
+		Version:   rl.GetVersionId(),
+		Method:    rl.GetMethod(),
+		URL:       rl.GetResource(),
+		Status:    int(rl.GetStatus()),
+		StartTime: usecTime(rl.GetStartTime()),
+		EndTime:   usecTime(rl.GetEndTime()),
+		Latency:   time.Duration(rl.GetLatency()) * time.Microsecond,
+	}
+	for _, l := range rl.Line {
+		r.AppLogs = append(r.AppLogs, AppLogLine{
+			Time:    usecTime(l.GetTime()),
+			Level:   LogLevel(l.GetLevel()) + LogDebug,
+			Message: l.GetLogMessage(),
+		})
+	}
+	return r
+}
@@ -0,0 +1,159 @@
+package appenginetesting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MinSDKVersion is the oldest App Engine SDK that NewContext runs.
+const MinSDKVersion = "1.9.0"
+
+// sdkLayouts are the directories holding dev_appserver.py in an SDK
+// installation: the root of the go_appengine SDK, or platform/google_appengine
+// in the Cloud SDK.
+var sdkLayouts = []string{".", filepath.Join("platform", "google_appengine")}
+
+// sdkDevAppserver returns the dev_appserver.py of the SDK installed in dir,
+// or "" if there is none.
+func sdkDevAppserver(dir string) string {
+	for _, layout := range sdkLayouts {
+		if p := filepath.Join(dir, layout, AppServerFileName); fileExists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// findDevAppserver returns the dev_appserver.py to run, looked up in order in
+// the configured SDK path, APPENGINE_DEV_APPSERVER and PATH, where it can also
+// be found through the goapp or gcloud commands of an SDK.
+func findDevAppserver(cfg *config) (string, error) {
+	if p := cfg.SDKPath; p != "" {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			p = sdkDevAppserver(p)
+		}
+		if p != "" && fileExists(p) {
+			return p, nil
+		}
+		return "", fmt.Errorf("invalid SDK path %q; %s not found", cfg.SDKPath, AppServerFileName)
+	}
+	if p := os.Getenv("APPENGINE_DEV_APPSERVER"); p != "" {
+		if fileExists(p) {
+			return p, nil
+		}
+		return "", fmt.Errorf("invalid APPENGINE_DEV_APPSERVER environment variable; path %q doesn't exist", p)
+	}
+	if p, err := exec.LookPath(AppServerFileName); err == nil {
+		// the Cloud SDK's bin/dev_appserver.py is a wrapper for the one in
+		// platform/google_appengine, next to the VERSION file
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			if sdk := sdkDevAppserver(filepath.Dir(filepath.Dir(real))); sdk != "" {
+				return sdk, nil
+			}
+		}
+		return p, nil
+	}
+	for _, cmd := range []string{"goapp", "gcloud"} {
+		p, err := exec.LookPath(cmd)
+		if err != nil {
+			continue
+		}
+		if real, err := filepath.EvalSymlinks(p); err == nil {
+			p = real
+		}
+		// goapp is at the root of go_appengine, gcloud in the Cloud SDK's bin
+		for _, dir := range []string{filepath.Dir(p), filepath.Dir(filepath.Dir(p))} {
+			if sdk := sdkDevAppserver(dir); sdk != "" {
+				return sdk, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s not found; install the App Engine SDK for Go or the Cloud SDK's app-engine-go component, or set APPENGINETESTING_SDK", AppServerFileName)
+}
+
+// findPython returns the interpreter for dev_appserver.py, the one of
+// Options, the configured one, the Cloud SDK's choice or the first python 2.7
+// in PATH.  Options come first as a test that sets PythonPath needs that
+// interpreter.
+func findPython(cfg *config, optsPython string) (path string, err error) {
+	for _, p := range []string{optsPython, cfg.PythonPath, os.Getenv("CLOUDSDK_PYTHON")} {
+		if p != "" {
+			return exec.LookPath(p)
+		}
+	}
+	for _, name := range []string{"python2.7", "python"} {
+		path, err = exec.LookPath(name)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// readSDKVersion returns the release in the VERSION file next to
+// dev_appserver.py, or "" if there is no such file.
+func readSDKVersion(devAppserver string) (string, error) {
+	if real, err := filepath.EvalSymlinks(devAppserver); err == nil {
+		devAppserver = real
+	}
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(devAppserver), "VERSION"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var v struct {
+		Release string `yaml:"release"`
+	}
+	if err = yaml.Unmarshal(data, &v); err != nil {
+		return "", fmt.Errorf("could not parse the SDK VERSION file - %v", err)
+	}
+	return v.Release, nil
+}
+
+// compareVersions returns -1, 0 or 1 as the dotted version a is older than,
+// the same as or newer than b.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkSDKVersion fails for SDK releases older than MinSDKVersion.  An
+// unknown release is let through.
+func checkSDKVersion(devAppserver, version string) error {
+	if version != "" && compareVersions(version, MinSDKVersion) < 0 {
+		return fmt.Errorf("App Engine SDK %s at %s is not supported, appenginetesting needs %s or newer", version, filepath.Dir(devAppserver), MinSDKVersion)
+	}
+	return nil
+}
+
+// SDKVersion returns the release of the App Engine SDK running the Context,
+// like "1.9.40", or "" if the SDK doesn't say.
+//
+// SDKVersion is not part of the appengine.Context interface.
+func (c *Context) SDKVersion() string {
+	return c.sdkVersion
+}
@@ -0,0 +1,154 @@
+package appenginetesting
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// startupTailLines is the number of lines of the child's output kept
+	// in a StartupError.
+	startupTailLines = 40
+	// startupGrace is how long the child may write out the rest of an
+	// error once a fatal line is seen.
+	startupGrace = 250 * time.Millisecond
+	// probeMinBackoff and probeMaxBackoff bound the wait between two
+	// requests to a module that isn't ready.
+	probeMinBackoff = 50 * time.Millisecond
+	probeMaxBackoff = time.Second
+	// probePath is requested from the modules to know they are ready,
+	// with probeUserAgent to leave the probes out of RequestLogs.
+	probePath      = "/_ah/warmup"
+	probeUserAgent = "appenginetesting-probe"
+)
+
+var errNotReady = errors.New("not ready")
+
+// StartupError is returned by NewContext when dev_appserver.py fails to
+// start, with the end of its output.
+type StartupError struct {
+	Reason string // what went wrong, like "Go compile error"
+	Detail string // the line of output telling so, if any
+	File   string // file of a compile error
+	Line   int    // line of a compile error
+	Output []string
+}
+
+func (e *StartupError) Error() string {
+	s := "dev_appserver.py failed to start - " + e.Reason
+	if e.File != "" {
+		s += fmt.Sprintf(" at %s:%d", e.File, e.Line)
+	}
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	if len(e.Output) > 0 {
+		s += fmt.Sprintf("\nlast %d lines of output:\n\t%s", len(e.Output), strings.Join(e.Output, "\n\t"))
+	}
+	return s
+}
+
+var (
+	// app.go:12: undefined: foo, or app.go:12:5: with a column
+	compileErrorRegex = regexp.MustCompile(`(\S+\.go):(\d+)(?::\d+)?: (.+)$`)
+	startupFailures   = []struct {
+		reason string
+		regex  *regexp.Regexp
+	}{
+		{"port already in use", regexp.MustCompile(`Address already in use|BindError`)},
+		{"missing application field", regexp.MustCompile(`(?i)missing required value \[application\]|no application id`)},
+		{"yaml error", regexp.MustCompile(`yaml\.\w+\.\w+Error|appinfo_errors\.\w+|Unable to assign value|while (?:parsing|scanning) a`)},
+	}
+)
+
+// startupFailure returns the StartupError of a line of the child's output
+// that means it can't start, or nil.
+func startupFailure(line string) *StartupError {
+	if m := compileErrorRegex.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return &StartupError{Reason: "Go compile error", Detail: m[3], File: m[1], Line: n}
+	}
+	for _, f := range startupFailures {
+		if f.regex.MatchString(line) {
+			return &StartupError{Reason: f.reason, Detail: strings.TrimSpace(line)}
+		}
+	}
+	return nil
+}
+
+// outputTail keeps the last lines of the child's output.
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == startupTailLines {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+func (t *outputTail) get() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+type probeResult struct {
+	name string
+	err  error
+}
+
+// probeURL returns the URL requested to know that a startup component is
+// ready, or "" for the API and admin servers.  Modules are sent a warmup
+// request, which starts an instance, and so builds the module's Go code, like
+// App Engine does before sending it traffic.  The application usually has no
+// handler for it, and a 404 is as good an answer as any.
+func probeURL(cu ComponentURL) string {
+	switch cu.Name {
+	case "appenginetestingapi", "appenginetestingadmin":
+		return ""
+	case aeFakeName:
+		return cu.URL + "/info"
+	}
+	return cu.URL + probePath
+}
+
+// probeReady requests url, waiting exponentially longer between requests,
+// until the module answers with a status under 500 and returns nil, or until
+// stop is closed and returns the last error.
+func probeReady(url string, stop <-chan struct{}) error {
+	backoff := probeMinBackoff
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", probeUserAgent)
+		res, err := httpClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 500 {
+				return nil
+			}
+			err = fmt.Errorf("got status %d", res.StatusCode)
+		}
+		select {
+		case <-stop:
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > probeMaxBackoff {
+			backoff = probeMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,12 @@
+// +build go1.14
+
+package appenginetesting
+
+import (
+	"testing"
+)
+
+// whenTestEnds calls f once the test of t has returned.
+func whenTestEnds(t *testing.T, f func()) {
+	t.Cleanup(f)
+}
@@ -0,0 +1,13 @@
+// +build !go1.14
+
+package appenginetesting
+
+import (
+	"testing"
+)
+
+// whenTestEnds does nothing, as testing.T can't tell when its test has
+// returned before Go 1.14.  A Context that isn't closed before its test
+// returns may then log to the finished test.
+func whenTestEnds(t *testing.T, f func()) {
+}